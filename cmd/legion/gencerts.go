@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	clientset "k8s.io/client-go/kubernetes"
+
+	"github.com/planetlabs/legion/internal/cert"
+)
+
+// configureGenCertsCommand configures the gen-certs command, which generates a
+// certificate authority and a serving certificate for the webhook.
+func configureGenCertsCommand(app *kingpin.Application, global globalFlags) {
+	var (
+		cmd = app.Command("gen-certs", "Generates a certificate authority and a certificate signed by it for the webhook to present.")
+
+		dnsNames     = cmd.Flag("dns-name", "DNS name for which the certificate is valid, e.g. legion.legion.svc.").PlaceHolder("NAME").Required().Strings()
+		certFile     = cmd.Flag("cert", "File to which to write the PEM encoded certificate, followed by the certificate authority.").Default("cert.pem").String()
+		keyFile      = cmd.Flag("key", "File to which to write the PEM encoded key.").Default("key.pem").String()
+		secret       = cmd.Flag("secret", "Write a TLS Secret rather than files. Requires access to the Kubernetes API.").PlaceHolder("NAMESPACE/NAME").String()
+		patchWebhook = cmd.Flag("patch-webhook-ca-bundle", "Patch the CA bundle of the named MutatingWebhookConfiguration. Requires access to the Kubernetes API.").PlaceHolder("NAME").String()
+		kubecfg      = cmd.Flag("kubeconfig", "Kubeconfig file to use when connecting to the Kubernetes API. Legion uses in-cluster config if unset.").ExistingFile()
+		validity     = cmd.Flag("validity", "How long the certificate is valid.").Default(cert.DefaultValidity.String()).Duration()
+		caValidity   = cmd.Flag("ca-validity", "How long the certificate authority is valid.").Default(cert.DefaultCAValidity.String()).Duration()
+	)
+
+	cmd.Action(func(_ *kingpin.ParseContext) error {
+		log, err := global.logger()
+		kingpin.FatalIfError(err, "cannot create log")
+		defer log.Sync() // nolint:errcheck,gosec
+
+		var client clientset.Interface
+		if *secret != "" || *patchWebhook != "" {
+			client, err = kubeClient(*kubecfg)
+			kingpin.FatalIfError(err, "cannot create Kubernetes client")
+		}
+
+		w := cert.WriteFiles(*certFile, *keyFile)
+		if *secret != "" {
+			namespace, name := namespacedName("secret", *secret)
+			w = cert.WriteSecret(client, namespace, name)
+		}
+
+		r := cert.NewRotator(*dnsNames,
+			cert.WithRotatorLogger(log),
+			cert.WithValidity(*validity),
+			cert.WithCAValidity(*caValidity),
+			cert.WithWriters(certWriters(client, *patchWebhook, w)...))
+		kingpin.FatalIfError(r.Rotate(context.Background()), "cannot generate certificate")
+		return nil
+	})
+}
+
+// namespacedName splits the value of the supplied flag, which must be of the
+// form NAMESPACE/NAME.
+func namespacedName(flag, v string) (string, string) {
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		kingpin.Fatalf("--%s must be of the form NAMESPACE/NAME", flag)
+	}
+	return parts[0], parts[1]
+}
+
+// certWriters returns Writers that patch the CA bundle of the named
+// MutatingWebhookConfiguration, if any, then write certificates using the
+// supplied Writer. The CA bundle is patched first so that a new certificate
+// authority is trusted before any certificate it signed is presented.
+func certWriters(client clientset.Interface, patchWebhook string, w cert.Writer) []cert.Writer {
+	if patchWebhook == "" {
+		return []cert.Writer{w}
+	}
+	return []cert.Writer{cert.PatchWebhookCABundle(client, patchWebhook), w}
+}
@@ -17,120 +17,133 @@ and limitations under the License.
 package main
 
 import (
-	"context"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
-	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
-	"go.opencensus.io/exporter/prometheus"
-	"go.opencensus.io/stats/view"
-	"go.opencensus.io/tag"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/planetlabs/legion/internal/kubernetes"
 )
 
 const component = "legion"
 
-func main() {
-	var (
-		app = kingpin.New(filepath.Base(os.Args[0]), "Serves an admission webhook that mutates pods according to the provided config.").DefaultEnvars()
-
-		debug          = app.Flag("debug", "Run with debug logging.").Short('d').Bool()
-		certFile       = app.Flag("cert", "File containing a PEM encoded certificate to be presented by the webhook listen address.").Default("cert.pem").ExistingFile()
-		keyFile        = app.Flag("key", "File containing a PEM encoded key to be presented by the webhook listen address.").Default("key.pem").ExistingFile()
-		listenWebhook  = app.Flag("listen-webhook", "Address at which to expose /webhook via HTTPS.").Default(":10002").String()
-		listenInsecure = app.Flag("listen-insecure", "Address at which to expose /metrics and /healthz via HTTP.").Default(":10003").String()
-
-		// TODO(negz) Move these settings into kubernetes.PodMutation? Currently
-		// these settings configure _which_ pods are mutated, while PodMutation
-		ignorePodsWithHostNetwork    = app.Flag("ignore-pods-with-host-network", "Do not mutate pods running in the host network namespace.").Bool()
-		ignorePodsWithAnnotations    = app.Flag("ignore-pods-with-annotation", "Do not mutate pods with the specified annotations.").PlaceHolder("KEY=VALUE").StringMap()
-		ignorePodsWithoutAnnotations = app.Flag("ignore-pods-without-annotation", "Do not mutate pods without the specified annotations").PlaceHolder("KEY=VALUE").StringMap()
-
-		config = app.Arg("config-file", "A PodMutation encoded as YAML or JSON.").ExistingFile()
-	)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+// globalFlags are the flags shared by all commands.
+type globalFlags struct {
+	debug         *bool
+	unknownFields *string
+	marker        *string
+	provenance    *string
 
-	var (
-		podsReviewed = &view.View{
-			Name:        "pods_reviewed_total",
-			Measure:     kubernetes.MeasurePodsReviewed,
-			Description: "Number of namespaces processed.",
-			Aggregation: view.Count(),
-			TagKeys:     []tag.Key{kubernetes.TagKind, kubernetes.TagNamespace, kubernetes.TagResult},
-		}
-	)
-	kingpin.FatalIfError(view.Register(podsReviewed), "cannot create metrics")
-	metrics, err := prometheus.NewExporter(prometheus.Options{Namespace: component})
-	kingpin.FatalIfError(err, "cannot export metrics")
-	view.RegisterExporter(metrics)
-
-	log, err := zap.NewProduction()
-	if *debug {
-		log, err = zap.NewDevelopment()
+	ignorePodsWithHostNetwork    *bool
+	ignorePodsWithAnnotations    *map[string]string
+	ignorePodsWithoutAnnotations *map[string]string
+}
+
+// logger returns a logger configured per the global flags.
+func (g globalFlags) logger() (*zap.Logger, error) {
+	if *g.debug {
+		return zap.NewDevelopment()
 	}
-	kingpin.FatalIfError(err, "cannot create log")
-	defer log.Sync() // nolint:errcheck,gosec
-
-	g, ctx := errgroup.WithContext(context.Background())
-	g.Go(func() error {
-		rt := httprouter.New()
-		rt.Handler(http.MethodGet, "/metrics", metrics)
-		rt.HandlerFunc(http.MethodGet, "/healthz", func(_ http.ResponseWriter, _ *http.Request) {})
-
-		log.Debug("listening for insecure requests", zap.String("listen", *listenInsecure))
-		s := http.Server{Addr: *listenInsecure, Handler: rt}
-		go func() {
-			<-ctx.Done()
-			sctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			defer cancel()
-			s.Shutdown(sctx) // nolint:errcheck,gosec
-		}()
-		return errors.Wrap(s.ListenAndServe(), "cannot serve insecure requests")
-	})
-
-	g.Go(func() error {
-		data, err := ioutil.ReadFile(*config)
-		if err != nil {
-			return errors.Wrap(err, "cannot read configuration file")
-		}
-		p, err := kubernetes.DecodePodMutation(data)
-		if err != nil {
-			return errors.Wrap(err, "cannot decode configuration file")
-		}
+	return zap.NewProduction()
+}
 
-		i := []kubernetes.IgnoreFunc{}
-		if *ignorePodsWithHostNetwork {
-			i = append(i, kubernetes.IgnorePodsInHostNetwork())
-		}
-		for k, v := range *ignorePodsWithAnnotations {
-			i = append(i, kubernetes.IgnorePodsWithAnnotation(k, v))
+// decodeOptions returns the DecodeOptions configured by the global flags.
+func (g globalFlags) decodeOptions(log *zap.Logger) []kubernetes.DecodeOption {
+	return []kubernetes.DecodeOption{
+		kubernetes.WithDecodeLogger(log),
+		kubernetes.WithUnknownFieldPolicy(kubernetes.UnknownFieldPolicy(*g.unknownFields)),
+	}
+}
+
+// ignoreFuncs returns the IgnoreFuncs configured by the global flags.
+func (g globalFlags) ignoreFuncs() []kubernetes.IgnoreFunc {
+	i := []kubernetes.IgnoreFunc{}
+	if *g.ignorePodsWithHostNetwork {
+		i = append(i, kubernetes.IgnorePodsInHostNetwork())
+	}
+	for k, v := range *g.ignorePodsWithAnnotations {
+		i = append(i, kubernetes.IgnorePodsWithAnnotation(k, v))
+	}
+	for k, v := range *g.ignorePodsWithoutAnnotations {
+		i = append(i, kubernetes.IgnorePodsWithoutAnnotation(k, v))
+	}
+	return i
+}
+
+// mutatorOptions returns the PodMutatorOptions configured by the global flags.
+// Provenance is recorded in the supplied MutationLog, if it is not nil.
+func (g globalFlags) mutatorOptions(log *zap.Logger, ml *kubernetes.MutationLog) ([]kubernetes.PodMutatorOption, error) {
+	o := []kubernetes.PodMutatorOption{kubernetes.WithLogger(log), kubernetes.WithIgnoreFuncs(g.ignoreFuncs()...)}
+	if *g.marker != "" {
+		if err := kubernetes.ValidateMarkerAnnotation(*g.marker); err != nil {
+			return nil, err
 		}
-		for k, v := range *ignorePodsWithoutAnnotations {
-			i = append(i, kubernetes.IgnorePodsWithoutAnnotation(k, v))
+		o = append(o, kubernetes.WithMarker(*g.marker))
+	}
+	if *g.provenance != "" {
+		if errs := validation.IsQualifiedName(*g.provenance); len(errs) > 0 {
+			return nil, errors.Errorf("invalid provenance annotation %q: %s", *g.provenance, strings.Join(errs, "; "))
 		}
+		o = append(o, kubernetes.WithProvenance(*g.provenance, ml))
+	}
+	return o, nil
+}
+
+// kubeConfig returns Kubernetes client configuration loaded from the supplied
+// kubeconfig file, or in-cluster config if the file is unset.
+func kubeConfig(kubecfg string) (*rest.Config, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubecfg)
+	return cfg, errors.Wrap(err, "cannot create Kubernetes client configuration")
+}
+
+// kubeClient returns a Kubernetes client configured by the supplied kubeconfig
+// file, or by in-cluster config if the file is unset.
+func kubeClient(kubecfg string) (clientset.Interface, error) {
+	cfg, err := kubeConfig(kubecfg)
+	if err != nil {
+		return nil, err
+	}
+	return clientset.NewForConfig(cfg)
+}
 
-		r := kubernetes.NewPodMutator(p, kubernetes.WithLogger(log), kubernetes.WithIgnoreFuncs(i...))
-		rt := httprouter.New()
-		rt.HandlerFunc(http.MethodPost, "/webhook", kubernetes.AdmissionReviewWebhook(r))
-
-		log.Debug("listening for webhook requests", zap.String("listen", *listenWebhook))
-		s := http.Server{Addr: *listenWebhook, Handler: rt}
-		go func() {
-			<-ctx.Done()
-			sctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			defer cancel()
-			s.Shutdown(sctx) // nolint:errcheck,gosec
-		}()
-		return errors.Wrap(s.ListenAndServeTLS(*certFile, *keyFile), "cannot serve webhook requests")
-	})
-
-	kingpin.FatalIfError(g.Wait(), "cannot serve HTTP requests")
+// dynamicClient returns a dynamic Kubernetes client configured by the supplied
+// kubeconfig file, or by in-cluster config if the file is unset.
+func dynamicClient(kubecfg string) (dynamic.Interface, error) {
+	cfg, err := kubeConfig(kubecfg)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(cfg)
+}
+
+func main() {
+	app := kingpin.New(filepath.Base(os.Args[0]), "Mutates pods according to the provided config.").DefaultEnvars()
+	g := globalFlags{
+		debug:         app.Flag("debug", "Run with debug logging.").Short('d').Bool(),
+		unknownFields: app.Flag("unknown-field-policy", "Whether to reject (Fail) or warn about (Warn) PodMutations with unknown or duplicate fields.").Default(string(kubernetes.FailOnUnknownFields)).Enum(string(kubernetes.FailOnUnknownFields), string(kubernetes.WarnOnUnknownFields)),
+		marker:        app.Flag("marker-annotation", "Annotation with which to mark mutated pods and record the PodMutations applied to them, e.g. "+kubernetes.DefaultMarkerAnnotation+". Pods with this annotation set to 'disabled' are not mutated. Pods are not marked if unset, unless --mutate-workloads is set.").String(),
+		provenance:    app.Flag("provenance-annotation", "Annotation in which to record the PodMutations applied to each pod and the paths they modified, e.g. "+kubernetes.DefaultProvenanceAnnotation+". Provenance is not recorded if unset.").String(),
+
+		// These settings apply to all PodMutations. Each PodMutation may further
+		// restrict which pods it mutates using its selector.
+		ignorePodsWithHostNetwork:    app.Flag("ignore-pods-with-host-network", "Do not mutate pods running in the host network namespace.").Bool(),
+		ignorePodsWithAnnotations:    app.Flag("ignore-pods-with-annotation", "Do not mutate pods with the specified annotations.").PlaceHolder("KEY=VALUE").StringMap(),
+		ignorePodsWithoutAnnotations: app.Flag("ignore-pods-without-annotation", "Do not mutate pods without the specified annotations").PlaceHolder("KEY=VALUE").StringMap(),
+	}
+
+	configureServeCommand(app, g)
+	configureMutateCommand(app, g)
+	configureValidateCommand(app, g)
+	configureWebhookConfigCommand(app, g)
+	configureGenCertsCommand(app, g)
+
+	kingpin.MustParse(app.Parse(os.Args[1:]))
 }
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	rfc6902 "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/alecthomas/kingpin.v2"
+	admission "k8s.io/api/admission/v1"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	authentication "k8s.io/api/authentication/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	"github.com/planetlabs/legion/internal/kubernetes"
+)
+
+// Output formats supported by the mutate command.
+const (
+	outputPatch = "patch"
+	outputPod   = "pod"
+	outputDiff  = "diff"
+)
+
+// stdin is the filename used to read an object from stdin.
+const stdin = "-"
+
+// configureMutateCommand configures the mutate command, which mutates a pod
+// locally and prints the result.
+func configureMutateCommand(app *kingpin.Application, global globalFlags) {
+	var (
+		cmd = app.Command("mutate", "Mutates a pod, or the pod template of a workload, according to the provided config and prints the result.")
+
+		output          = cmd.Flag("output", "Print the JSON patch (patch), the mutated pod or workload (pod), or a unified diff of the original and mutated objects (diff).").Short('o').Default(outputPatch).Enum(outputPatch, outputPod, outputDiff)
+		namespace       = cmd.Flag("namespace", "Namespace in which the pod is created, if it does not specify one.").Short('n').Default(meta.NamespaceDefault).String()
+		namespaceLabels = cmd.Flag("namespace-label", "Labels of the pod's namespace. Namespace selectors match no namespaces if unset.").PlaceHolder("KEY=VALUE").StringMap()
+		username        = cmd.Flag("username", "Username of the user creating the pod.").String()
+		groups          = cmd.Flag("group", "Groups of the user creating the pod.").Strings()
+
+		config = cmd.Arg("config", "A PodMutation, or a directory of PodMutations, encoded as YAML or JSON.").Required().ExistingFileOrDir()
+		object = cmd.Arg("object", "A pod or workload encoded as YAML or JSON. Read from stdin if omitted or '-'.").Default(stdin).String()
+	)
+
+	cmd.Action(func(_ *kingpin.ParseContext) error {
+		log, err := global.logger()
+		kingpin.FatalIfError(err, "cannot create log")
+		defer log.Sync() // nolint:errcheck,gosec
+
+		pms, err := kubernetes.LoadPodMutations(*config, global.decodeOptions(log)...)
+		kingpin.FatalIfError(err, "cannot load configuration")
+
+		data, err := readObject(*object)
+		kingpin.FatalIfError(err, "cannot read object")
+
+		// Objects are reviewed exactly as the webhook would review them, so
+		// the patch for a workload applies to its pod template.
+		original, err := yaml.YAMLToJSON(data)
+		kingpin.FatalIfError(err, "cannot decode object")
+		obj := &unstructured.Unstructured{}
+		kingpin.FatalIfError(obj.UnmarshalJSON(original), "cannot decode object")
+		gvk := obj.GroupVersionKind()
+		gvr, _ := apimeta.UnsafeGuessKindToResource(gvk)
+		ns := *namespace
+		if obj.GetNamespace() != "" {
+			ns = obj.GetNamespace()
+		}
+
+		o, err := global.mutatorOptions(log, nil)
+		kingpin.FatalIfError(err, "cannot configure mutator")
+		if _, ok := kubernetes.PodTemplatePath(gvk.GroupKind()); ok {
+			o = append(o, kubernetes.WithWorkloads())
+		}
+		if len(*namespaceLabels) > 0 {
+			l := kubernetes.StaticNamespaceLabels{ns: labels.Set(*namespaceLabels)}
+			o = append(o, kubernetes.WithNamespaceLabeler(l, admissionregistration.Ignore))
+		}
+
+		rsp := kubernetes.NewPodMutator(pms, o...).Review(&admission.AdmissionRequest{
+			UID:       "legion-mutate",
+			Kind:      meta.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+			Resource:  meta.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+			Name:      obj.GetName(),
+			Namespace: ns,
+			Operation: admission.Create,
+			UserInfo:  authentication.UserInfo{Username: *username, Groups: *groups},
+			Object:    runtime.RawExtension{Raw: original},
+		})
+		if !rsp.Allowed {
+			kingpin.Fatalf("%s was rejected: %s", gvk.Kind, rsp.Result.Message)
+		}
+		patch := rsp.Patch
+		if patch == nil {
+			patch = []byte("[]")
+		}
+
+		switch *output {
+		case outputPatch:
+			b := &bytes.Buffer{}
+			kingpin.FatalIfError(json.Indent(b, patch, "", "  "), "cannot format patch")
+			fmt.Fprintln(os.Stdout, b.String())
+		case outputPod:
+			_, mutated, err := applyPatch(original, patch)
+			kingpin.FatalIfError(err, "cannot apply patch")
+			fmt.Fprint(os.Stdout, string(mutated))
+		case outputDiff:
+			before, after, err := applyPatch(original, patch)
+			kingpin.FatalIfError(err, "cannot apply patch")
+			d, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        difflib.SplitLines(string(before)),
+				B:        difflib.SplitLines(string(after)),
+				FromFile: "original",
+				ToFile:   "mutated",
+				Context:  3,
+			})
+			kingpin.FatalIfError(err, "cannot diff objects")
+			fmt.Fprint(os.Stdout, d)
+		}
+		return nil
+	})
+}
+
+func readObject(filename string) ([]byte, error) {
+	if filename == stdin {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(filename) // nolint:gosec
+}
+
+// applyPatch applies the supplied JSON patch to the supplied JSON encoded
+// object, returning the original and patched objects encoded as YAML.
+func applyPatch(original, patch []byte) ([]byte, []byte, error) {
+	p, err := rfc6902.DecodePatch(patch)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decode patch")
+	}
+	patched, err := p.Apply(original)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot apply patch")
+	}
+	before, err := yaml.JSONToYAML(original)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot encode original object as YAML")
+	}
+	after, err := yaml.JSONToYAML(patched)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot encode mutated object as YAML")
+	}
+	return before, after, nil
+}
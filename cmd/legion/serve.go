@@ -0,0 +1,315 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/alecthomas/kingpin.v2"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	clientset "k8s.io/client-go/kubernetes"
+
+	"github.com/planetlabs/legion/internal/cert"
+	"github.com/planetlabs/legion/internal/kubernetes"
+)
+
+// configureServeCommand configures the default serve command, which serves an
+// admission webhook that mutates pods.
+func configureServeCommand(app *kingpin.Application, global globalFlags) {
+	var (
+		cmd = app.Command("serve", "Serves an admission webhook that mutates pods according to the provided config.").Default()
+
+		certFile       = cmd.Flag("cert", "File containing a PEM encoded certificate to be presented by the webhook listen address.").Default("cert.pem").String()
+		keyFile        = cmd.Flag("key", "File containing a PEM encoded key to be presented by the webhook listen address.").Default("key.pem").String()
+		listenWebhook  = cmd.Flag("listen-webhook", "Address at which to expose /webhook and /validate via HTTPS.").Default(":10002").String()
+		listenInsecure = cmd.Flag("listen-insecure", "Address at which to expose /metrics, /healthz, and /debug/last-mutations via HTTP.").Default(":10003").String()
+		mode           = cmd.Flag("mode", "Whether to mutate pods (Enforce), or only log how they would have been mutated (Audit). Audit applies to all PodMutations regardless of their mode.").Default(string(kubernetes.EnforceMode)).Enum(string(kubernetes.EnforceMode), string(kubernetes.AuditMode))
+		validationMode = cmd.Flag("validation-mode", "Whether /validate should allow pods that do not conform to the PodMutations with warnings (Warn), or deny them (Enforce).").Default(string(kubernetes.WarnValidation)).Enum(string(kubernetes.WarnValidation), string(kubernetes.EnforceValidation))
+		kubecfg        = cmd.Flag("kubeconfig", "Kubeconfig file to use when connecting to the Kubernetes API. Legion uses in-cluster config if unset.").ExistingFile()
+
+		watchPodMutations = cmd.Flag("watch-podmutations", "Watch PodMutation and ClusterPodMutation custom resources, in addition to any provided config. Requires access to the Kubernetes API.").Bool()
+		watchNamespaces   = cmd.Flag("watch-namespaces", "Watch namespaces in order to evaluate PodMutation namespace selectors. Requires access to the Kubernetes API.").Bool()
+		unknownNamespace  = cmd.Flag("unknown-namespace-policy", "Whether to reject (Fail) or mutate while ignoring namespace selectors (Ignore) pods whose namespace labels are unknown.").Default(string(admissionregistration.Fail)).Enum(string(admissionregistration.Fail), string(admissionregistration.Ignore))
+
+		generateCert     = cmd.Flag("generate-cert-dns-name", "Generate a certificate for the supplied DNS names at startup, writing it to the --cert and --key files and regenerating it before it expires. Certificates are signed by the stored certificate authority, which is generated if it does not exist or is about to expire.").PlaceHolder("NAME").Strings()
+		generateExpiry   = cmd.Flag("generate-cert-validity", "How long generated certificates are valid.").Default(cert.DefaultValidity.String()).Duration()
+		generateCAExpiry = cmd.Flag("generate-ca-validity", "How long generated certificate authorities are valid.").Default(cert.DefaultCAValidity.String()).Duration()
+		generateCACert   = cmd.Flag("generate-ca-cert", "File in which to store the generated certificate authority, which is reused until it expires.").Default("ca.pem").String()
+		generateCAKey    = cmd.Flag("generate-ca-key", "File in which to store the key of the generated certificate authority.").Default("ca-key.pem").String()
+		generateCASecret = cmd.Flag("generate-ca-secret", "Store the generated certificate authority in the named TLS Secret rather than files, sharing it between replicas. Required by --patch-webhook-ca-bundle and --register-webhook. Requires access to the Kubernetes API.").PlaceHolder("NAMESPACE/NAME").String()
+		patchWebhook     = cmd.Flag("patch-webhook-ca-bundle", "Patch the CA bundle of the named MutatingWebhookConfiguration whenever a certificate is generated. Requires access to the Kubernetes API.").PlaceHolder("NAME").String()
+
+		registerWebhook   = cmd.Flag("register-webhook", "Create or update the MutatingWebhookConfiguration at startup and whenever the config changes. Requires access to the Kubernetes API.").Bool()
+		deregisterWebhook = cmd.Flag("deregister-webhook", "Delete the MutatingWebhookConfiguration when Legion shuts down gracefully. Requires --register-webhook. Only safe when running a single replica; each replica deletes the shared MutatingWebhookConfiguration, so pods are admitted without mutation until another replica registers it again.").Bool()
+		webhook           = addWebhookFlags(cmd)
+
+		config = cmd.Arg("config", "A PodMutation, or a directory of PodMutations, encoded as YAML or JSON. Optional if --watch-podmutations is set.").ExistingFileOrDir()
+	)
+
+	cmd.Action(func(_ *kingpin.ParseContext) error {
+		var (
+			podsReviewed = &view.View{
+				Name:        "pods_reviewed_total",
+				Measure:     kubernetes.MeasurePodsReviewed,
+				Description: "Number of namespaces processed.",
+				Aggregation: view.Count(),
+				TagKeys:     []tag.Key{kubernetes.TagKind, kubernetes.TagNamespace, kubernetes.TagResult, kubernetes.TagDryRun},
+			}
+			podsAudited = &view.View{
+				Name:        "pods_audited_total",
+				Measure:     kubernetes.MeasurePodsAudited,
+				Description: "Number of pods PodMutations in audit mode would have mutated.",
+				Aggregation: view.Count(),
+				TagKeys:     []tag.Key{kubernetes.TagKind, kubernetes.TagNamespace, kubernetes.TagDryRun},
+			}
+			podsValidated = &view.View{
+				Name:        "pods_validated_total",
+				Measure:     kubernetes.MeasurePodsValidated,
+				Description: "Number of pods validated.",
+				Aggregation: view.Count(),
+				TagKeys:     []tag.Key{kubernetes.TagKind, kubernetes.TagNamespace, kubernetes.TagResult, kubernetes.TagDryRun},
+			}
+			configGeneration = &view.View{
+				Name:        "config_generation",
+				Measure:     kubernetes.MeasureConfigGeneration,
+				Description: "Generation of the loaded configuration.",
+				Aggregation: view.LastValue(),
+			}
+			configReloads = &view.View{
+				Name:        "config_reloads_total",
+				Measure:     kubernetes.MeasureConfigReloads,
+				Description: "Number of configuration reloads.",
+				Aggregation: view.Count(),
+				TagKeys:     []tag.Key{kubernetes.TagResult},
+			}
+			certExpiry = &view.View{
+				Name:        "certificate_expiry_seconds",
+				Measure:     cert.MeasureCertificateExpiry,
+				Description: "Unix time at which the served certificate expires.",
+				Aggregation: view.LastValue(),
+			}
+		)
+		kingpin.FatalIfError(view.Register(podsReviewed, podsAudited, podsValidated, configGeneration, configReloads, certExpiry), "cannot create metrics")
+		metrics, err := prometheus.NewExporter(prometheus.Options{Namespace: component})
+		kingpin.FatalIfError(err, "cannot export metrics")
+		view.RegisterExporter(metrics)
+
+		log, err := global.logger()
+		kingpin.FatalIfError(err, "cannot create log")
+		defer log.Sync() // nolint:errcheck,gosec
+
+		if *deregisterWebhook && !*registerWebhook {
+			kingpin.Fatalf("--deregister-webhook requires --register-webhook")
+		}
+		// Replicas that each stored their own certificate authority would
+		// each publish a CA bundle trusting only their own certificates.
+		if len(*generateCert) > 0 && (*patchWebhook != "" || *registerWebhook) && *generateCASecret == "" {
+			kingpin.Fatalf("--generate-cert-dns-name requires --generate-ca-secret when used with --patch-webhook-ca-bundle or --register-webhook")
+		}
+		if *config == "" && !*watchPodMutations {
+			kingpin.Fatalf("a config is required unless --watch-podmutations is set")
+		}
+
+		var client clientset.Interface
+		if *watchNamespaces || *patchWebhook != "" || *registerWebhook || *generateCASecret != "" {
+			client, err = kubeClient(*kubecfg)
+			kingpin.FatalIfError(err, "cannot create Kubernetes client")
+		}
+
+		// The webhook applies the PodMutations of all sources, so the
+		// registrar derives its selectors from all sources.
+		var sources kubernetes.PodMutationSources
+		ro := []kubernetes.ReloaderOption{kubernetes.WithReloaderLogger(log), kubernetes.WithDecodeOptions(global.decodeOptions(log)...)}
+		wo := []kubernetes.WatcherOption{kubernetes.WithWatcherLogger(log), kubernetes.WithWatcherDecodeOptions(global.decodeOptions(log)...)}
+		var reg *kubernetes.WebhookRegistrar
+		if *registerWebhook {
+			bundle := func() ([]byte, error) { return cert.CABundle(*certFile) }
+			rego := []kubernetes.WebhookRegistrarOption{kubernetes.WithRegistrarLogger(log), kubernetes.WithWebhookOptions(webhook.options()...)}
+			if *webhook.workloads {
+				rego = append(rego, kubernetes.WithWorkloadWebhook())
+			}
+			reg = kubernetes.NewWebhookRegistrar(client, *webhook.name, webhook.service(), bundle, rego...)
+			register := func(_ kubernetes.PodMutations) {
+				if err := reg.Register(context.Background(), sources.PodMutations()); err != nil {
+					log.Info("cannot register webhook", zap.Error(err))
+				}
+			}
+			ro = append(ro, kubernetes.WithReloadFuncs(register))
+			wo = append(wo, kubernetes.WithWatchFuncs(register))
+		}
+
+		var p *kubernetes.Reloader
+		if *config != "" {
+			p, err = kubernetes.NewReloader(*config, ro...)
+			kingpin.FatalIfError(err, "cannot load configuration")
+			sources = append(sources, p)
+		}
+
+		var pw *kubernetes.PodMutationWatcher
+		if *watchPodMutations {
+			dc, err := dynamicClient(*kubecfg)
+			kingpin.FatalIfError(err, "cannot create Kubernetes client")
+			pw = kubernetes.NewPodMutationWatcher(dc, wo...)
+			sources = append(sources, pw)
+		}
+
+		var rotator *cert.Rotator
+		if len(*generateCert) > 0 {
+			store := cert.CAFiles(*generateCACert, *generateCAKey)
+			if *generateCASecret != "" {
+				namespace, name := namespacedName("generate-ca-secret", *generateCASecret)
+				store = cert.CASecret(client, namespace, name)
+			}
+			rotator = cert.NewRotator(*generateCert,
+				cert.WithRotatorLogger(log),
+				cert.WithValidity(*generateExpiry),
+				cert.WithCAValidity(*generateCAExpiry),
+				cert.WithCAStore(store),
+				cert.WithWriters(certWriters(client, *patchWebhook, cert.WriteFiles(*certFile, *keyFile))...))
+			kingpin.FatalIfError(rotator.Rotate(context.Background()), "cannot generate certificate")
+		}
+
+		c, err := cert.NewReloader(*certFile, *keyFile, cert.WithLogger(log))
+		kingpin.FatalIfError(err, "cannot load certificate")
+
+		ml := kubernetes.NewMutationLog(kubernetes.DefaultMutationLogSize)
+		mo, err := global.mutatorOptions(log, ml)
+		kingpin.FatalIfError(err, "cannot configure mutator")
+
+		var ns *kubernetes.NamespaceCache
+		if *watchNamespaces {
+			ns = kubernetes.NewNamespaceCache(client)
+		}
+
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			s := <-sig
+			log.Info("shutting down", zap.String("signal", s.String()))
+			stop()
+		}()
+
+		g, ctx := errgroup.WithContext(ctx)
+		if rotator != nil {
+			g.Go(func() error {
+				return errors.Wrap(rotator.Run(ctx), "cannot rotate certificate")
+			})
+		}
+		if p != nil {
+			g.Go(func() error {
+				return errors.Wrap(p.Run(ctx), "cannot watch configuration")
+			})
+		}
+		if pw != nil {
+			g.Go(func() error {
+				return errors.Wrap(pw.Run(ctx), "cannot watch PodMutations")
+			})
+			if !pw.WaitForSync(ctx) {
+				kingpin.Fatalf("cannot sync PodMutations from the Kubernetes API")
+			}
+		}
+		if reg != nil {
+			kingpin.FatalIfError(reg.Register(ctx, sources.PodMutations()), "cannot register webhook")
+		}
+		if ns != nil {
+			g.Go(func() error {
+				return errors.Wrap(ns.Run(ctx), "cannot watch namespaces")
+			})
+			if !ns.WaitForSync(ctx) {
+				kingpin.Fatalf("cannot sync namespaces from the Kubernetes API")
+			}
+		}
+		g.Go(func() error {
+			return errors.Wrap(c.Run(ctx), "cannot watch certificate")
+		})
+
+		g.Go(func() error {
+			rt := httprouter.New()
+			rt.Handler(http.MethodGet, "/metrics", metrics)
+			rt.HandlerFunc(http.MethodGet, "/healthz", func(_ http.ResponseWriter, _ *http.Request) {})
+			rt.Handler(http.MethodGet, "/debug/last-mutations", ml)
+
+			log.Debug("listening for insecure requests", zap.String("listen", *listenInsecure))
+			s := http.Server{Addr: *listenInsecure, Handler: rt}
+			go func() {
+				<-ctx.Done()
+				sctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				s.Shutdown(sctx) // nolint:errcheck,gosec
+			}()
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				return errors.Wrap(err, "cannot serve insecure requests")
+			}
+			return nil
+		})
+
+		g.Go(func() error {
+			o := mo
+			if *webhook.workloads {
+				o = append(o, kubernetes.WithWorkloads())
+			}
+			if ns != nil {
+				o = append(o, kubernetes.WithNamespaceLabeler(ns, admissionregistration.FailurePolicyType(*unknownNamespace)))
+			}
+			r := kubernetes.NewPodMutator(sources, append(o, kubernetes.WithMode(kubernetes.PodMutationMode(*mode)))...)
+			v := kubernetes.NewPodValidator(sources,
+				kubernetes.WithValidatorLogger(log),
+				kubernetes.WithValidationMode(kubernetes.ValidationMode(*validationMode)),
+				kubernetes.WithMutatorOptions(o...))
+			rt := httprouter.New()
+			rt.HandlerFunc(http.MethodPost, "/webhook", kubernetes.AdmissionReviewWebhook(r))
+			rt.HandlerFunc(http.MethodPost, "/validate", kubernetes.AdmissionReviewWebhook(v))
+
+			log.Debug("listening for webhook requests", zap.String("listen", *listenWebhook))
+			s := http.Server{Addr: *listenWebhook, Handler: rt, TLSConfig: &tls.Config{GetCertificate: c.GetCertificate}}
+			go func() {
+				<-ctx.Done()
+				sctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				s.Shutdown(sctx) // nolint:errcheck,gosec
+			}()
+			if err := s.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				return errors.Wrap(err, "cannot serve webhook requests")
+			}
+			return nil
+		})
+
+		kingpin.FatalIfError(g.Wait(), "cannot serve HTTP requests")
+
+		if *deregisterWebhook {
+			dctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			kingpin.FatalIfError(reg.Deregister(dctx), "cannot deregister webhook")
+		}
+		return nil
+	})
+}
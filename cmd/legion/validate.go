@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/planetlabs/legion/internal/kubernetes"
+)
+
+// configureValidateCommand configures the validate command, which reports
+// any problems with the supplied configuration.
+func configureValidateCommand(app *kingpin.Application, global globalFlags) {
+	var (
+		cmd = app.Command("validate", "Validates PodMutations, reporting every problem found. Each file or directory is validated as a standalone configuration.")
+
+		configs = cmd.Arg("config", "PodMutations, or directories of PodMutations, encoded as YAML or JSON.").Required().ExistingFilesOrDirs()
+	)
+
+	cmd.Action(func(_ *kingpin.ParseContext) error {
+		log, err := global.logger()
+		kingpin.FatalIfError(err, "cannot create log")
+		defer log.Sync() // nolint:errcheck,gosec
+
+		valid := true
+		for _, c := range *configs {
+			if _, err := kubernetes.LoadPodMutations(c, global.decodeOptions(log)...); err != nil {
+				valid = false
+				for _, p := range problems(err) {
+					fmt.Fprintln(os.Stdout, p)
+				}
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%s: valid\n", c)
+		}
+		if !valid {
+			kingpin.Fatalf("invalid configuration")
+		}
+		return nil
+	})
+}
+
+// problems returns each of the problems described by the supplied error.
+func problems(err error) []string {
+	agg, ok := errors.Cause(err).(utilerrors.Aggregate)
+	if !ok {
+		return []string{err.Error()}
+	}
+	p := []string{}
+	for _, e := range agg.Errors() {
+		p = append(p, e.Error())
+	}
+	return p
+}
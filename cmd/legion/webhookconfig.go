@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/planetlabs/legion/internal/cert"
+	"github.com/planetlabs/legion/internal/kubernetes"
+)
+
+// Output formats supported by the webhook-config command.
+const (
+	outputYAML = "yaml"
+	outputJSON = "json"
+)
+
+// webhookFlags configure the MutatingWebhookConfiguration that registers
+// Legion with the API server.
+type webhookFlags struct {
+	name             *string
+	serviceNamespace *string
+	serviceName      *string
+	servicePort      *int32
+	path             *string
+	failurePolicy    *string
+	timeout          *int32
+	reinvocation     *string
+	workloads        *bool
+}
+
+// addWebhookFlags adds the flags that configure the MutatingWebhookConfiguration
+// to the supplied command.
+func addWebhookFlags(cmd *kingpin.CmdClause) webhookFlags {
+	return webhookFlags{
+		name:             cmd.Flag("webhook-name", "Name of the MutatingWebhookConfiguration and its webhook.").Default("legion.planet.com").String(),
+		serviceNamespace: cmd.Flag("service-namespace", "Namespace of the Service that exposes the webhook.").Default("legion").String(),
+		serviceName:      cmd.Flag("service-name", "Name of the Service that exposes the webhook.").Default("legion").String(),
+		servicePort:      cmd.Flag("service-port", "Port of the Service that exposes the webhook.").Default("443").Int32(),
+		path:             cmd.Flag("webhook-path", "Path at which the webhook is served.").Default("/webhook").String(),
+		failurePolicy:    cmd.Flag("webhook-failure-policy", "Whether the API server should reject (Fail) or admit unmutated (Ignore) pods it cannot send to Legion.").Default(string(admissionregistration.Fail)).Enum(string(admissionregistration.Fail), string(admissionregistration.Ignore)),
+		timeout:          cmd.Flag("webhook-timeout", "Seconds the API server should wait for Legion to review a pod.").Default(fmt.Sprint(kubernetes.DefaultWebhookTimeoutSeconds)).Int32(),
+		reinvocation:     cmd.Flag("webhook-reinvocation-policy", "Whether the API server should send pods to Legion again (IfNeeded) or not (Never) if other webhooks modify them after Legion reviews them.").Default(string(admissionregistration.NeverReinvocationPolicy)).Enum(string(admissionregistration.NeverReinvocationPolicy), string(admissionregistration.IfNeededReinvocationPolicy)),
+		workloads:        cmd.Flag("mutate-workloads", "Mutate the pod templates of Deployments, StatefulSets, DaemonSets, ReplicaSets, Jobs, and CronJobs in addition to pods. Implies marking mutated pods and pod templates, using --marker-annotation or "+kubernetes.DefaultMarkerAnnotation+".").Bool(),
+	}
+}
+
+// service returns the Service that exposes the webhook.
+func (f webhookFlags) service() admissionregistration.ServiceReference {
+	return admissionregistration.ServiceReference{
+		Namespace: *f.serviceNamespace,
+		Name:      *f.serviceName,
+		Path:      f.path,
+		Port:      f.servicePort,
+	}
+}
+
+// options returns the WebhookOptions configured by the flags.
+func (f webhookFlags) options() []kubernetes.WebhookOption {
+	return []kubernetes.WebhookOption{
+		kubernetes.WithFailurePolicy(admissionregistration.FailurePolicyType(*f.failurePolicy)),
+		kubernetes.WithTimeoutSeconds(*f.timeout),
+		kubernetes.WithReinvocationPolicy(admissionregistration.ReinvocationPolicyType(*f.reinvocation)),
+	}
+}
+
+// configureWebhookConfigCommand configures the webhook-config command, which
+// prints a MutatingWebhookConfiguration for the supplied config.
+func configureWebhookConfigCommand(app *kingpin.Application, global globalFlags) {
+	var (
+		cmd = app.Command("webhook-config", "Prints a MutatingWebhookConfiguration that sends pods to Legion for review. Its selectors are derived from the provided config.")
+
+		output   = cmd.Flag("output", "Print the MutatingWebhookConfiguration as YAML or JSON.").Short('o').Default(outputYAML).Enum(outputYAML, outputJSON)
+		certFile = cmd.Flag("cert", "File containing the PEM encoded certificate chain presented by the webhook. Its issuers, or the certificate itself if it is self-signed, form the CA bundle.").Default("cert.pem").ExistingFile()
+		webhook  = addWebhookFlags(cmd)
+
+		config = cmd.Arg("config", "A PodMutation, or a directory of PodMutations, encoded as YAML or JSON.").Required().ExistingFileOrDir()
+	)
+
+	cmd.Action(func(_ *kingpin.ParseContext) error {
+		log, err := global.logger()
+		kingpin.FatalIfError(err, "cannot create log")
+		defer log.Sync() // nolint:errcheck,gosec
+
+		pms, err := kubernetes.LoadPodMutations(*config, global.decodeOptions(log)...)
+		kingpin.FatalIfError(err, "cannot load configuration")
+
+		bundle, err := cert.CABundle(*certFile)
+		kingpin.FatalIfError(err, "cannot load CA bundle")
+
+		wc := kubernetes.NewMutatingWebhookConfiguration(*webhook.name, webhook.service(), bundle, pms, webhook.options()...)
+		if *webhook.workloads {
+			wc.Webhooks = append(wc.Webhooks, kubernetes.NewWorkloadMutatingWebhook(kubernetes.WorkloadWebhookName(*webhook.name), webhook.service(), bundle, pms, webhook.options()...))
+		}
+
+		var out []byte
+		switch *output {
+		case outputYAML:
+			out, err = yaml.Marshal(wc)
+		case outputJSON:
+			out, err = json.MarshalIndent(wc, "", "  ")
+			out = append(out, '\n')
+		}
+		kingpin.FatalIfError(err, "cannot encode MutatingWebhookConfiguration")
+		fmt.Fprint(os.Stdout, string(out))
+		return nil
+	})
+}
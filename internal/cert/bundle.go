@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const pemTypeCertificate = "CERTIFICATE"
+
+// CABundle returns the PEM encoded certificates with which clients may verify
+// the certificate chain in the supplied PEM encoded certificate file. These are
+// the certificates that follow the leaf certificate, or the leaf certificate
+// itself if it is the only certificate in the file (i.e. it is self-signed).
+func CABundle(certFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(certFile) // nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", certFile)
+	}
+
+	certs := []*pem.Block{}
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		if b.Type != pemTypeCertificate {
+			continue
+		}
+		certs = append(certs, b)
+	}
+
+	switch len(certs) {
+	case 0:
+		return nil, errors.Errorf("%s contains no PEM encoded certificates", certFile)
+	case 1:
+		return pem.EncodeToMemory(certs[0]), nil
+	}
+
+	bundle := &bytes.Buffer{}
+	for _, b := range certs[1:] {
+		if err := pem.Encode(bundle, b); err != nil {
+			return nil, errors.Wrap(err, "cannot encode certificate")
+		}
+	}
+	return bundle.Bytes(), nil
+}
+
+// splitBundle returns the first PEM encoded certificate of the supplied bundle,
+// and the remaining PEM encoded certificates. It returns a nil certificate if
+// the bundle contains none.
+func splitBundle(bundle []byte) ([]byte, []byte) {
+	var first []byte
+	rest := &bytes.Buffer{}
+	for {
+		var b *pem.Block
+		b, bundle = pem.Decode(bundle)
+		if b == nil {
+			break
+		}
+		if b.Type != pemTypeCertificate {
+			continue
+		}
+		if first == nil {
+			first = pem.EncodeToMemory(b)
+			continue
+		}
+		rest.Write(pem.EncodeToMemory(b))
+	}
+	return first, rest.Bytes()
+}
+
+// unexpired returns the PEM encoded certificates of the supplied bundle that
+// have not expired at the supplied time.
+func unexpired(bundle []byte, now time.Time) []byte {
+	out := &bytes.Buffer{}
+	for {
+		var b *pem.Block
+		b, bundle = pem.Decode(bundle)
+		if b == nil {
+			break
+		}
+		if b.Type != pemTypeCertificate {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil || !now.Before(c.NotAfter) {
+			continue
+		}
+		out.Write(pem.EncodeToMemory(b))
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	leafFile := filepath.Join(dir, "leaf.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeKeyPair(t, leafFile, filepath.Join(dir, "leaf-key.pem"), 1)
+	writeKeyPair(t, caFile, filepath.Join(dir, "ca-key.pem"), 2)
+
+	leaf, err := ioutil.ReadFile(leafFile)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(...): %v", err)
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(...): %v", err)
+	}
+	chainFile := filepath.Join(dir, "chain.pem")
+	if err := ioutil.WriteFile(chainFile, append(append([]byte{}, leaf...), ca...), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, []byte("imnotacertificate"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		file    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "SelfSigned", file: leafFile, want: leaf},
+		{name: "Chain", file: chainFile, want: ca},
+		{name: "NoCertificates", file: emptyFile, wantErr: true},
+		{name: "MissingFile", file: filepath.Join(dir, "missing.pem"), wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CABundle(tc.file)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("CABundle(%q): want error, got nil", tc.file)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CABundle(%q): %v", tc.file, err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("CABundle(%q): got != want:\n%s\n%s", tc.file, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const pemTypeECPrivateKey = "EC PRIVATE KEY"
+
+// clockSkew is subtracted from the start of each generated certificate's
+// validity period to tolerate clocks that are slightly behind ours.
+const clockSkew = 5 * time.Minute
+
+// A KeyPair is a PEM encoded certificate and private key.
+type KeyPair struct {
+	Cert []byte
+	Key  []byte
+}
+
+// Certificate returns the parsed certificate of the KeyPair.
+func (kp KeyPair) Certificate() (*x509.Certificate, error) {
+	b, _ := pem.Decode(kp.Cert)
+	if b == nil || b.Type != pemTypeCertificate {
+		return nil, errors.New("cannot decode PEM encoded certificate")
+	}
+	c, err := x509.ParseCertificate(b.Bytes)
+	return c, errors.Wrap(err, "cannot parse certificate")
+}
+
+// GenerateCA returns a self-signed certificate authority with the supplied
+// common name, valid for the supplied duration.
+func GenerateCA(commonName string, validity time.Duration) (KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return KeyPair{}, errors.Wrap(err, "cannot generate key")
+	}
+	tmpl, err := template(commonName, validity)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return encode(tmpl, tmpl, key, key)
+}
+
+// GenerateServing returns a serving certificate for the supplied DNS names,
+// signed by the supplied certificate authority and valid for the supplied
+// duration.
+func GenerateServing(ca KeyPair, dnsNames []string, validity time.Duration) (KeyPair, error) {
+	if len(dnsNames) == 0 {
+		return KeyPair{}, errors.New("at least one DNS name is required")
+	}
+	pair, err := tls.X509KeyPair(ca.Cert, ca.Key)
+	if err != nil {
+		return KeyPair{}, errors.Wrap(err, "cannot load certificate authority")
+	}
+	parent, err := ca.Certificate()
+	if err != nil {
+		return KeyPair{}, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return KeyPair{}, errors.New("certificate authority key cannot sign certificates")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return KeyPair{}, errors.Wrap(err, "cannot generate key")
+	}
+	tmpl, err := template(dnsNames[0], validity)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	tmpl.DNSNames = dnsNames
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if parent.NotAfter.Before(tmpl.NotAfter) {
+		// A certificate cannot outlive its issuer.
+		tmpl.NotAfter = parent.NotAfter
+	}
+	return encode(tmpl, parent, key, signer)
+}
+
+// template returns a certificate template with a random serial number.
+func template(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate serial number")
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// encode returns a KeyPair containing the supplied certificate template, signed
+// by the supplied parent, and its key.
+func encode(tmpl, parent *x509.Certificate, key *ecdsa.PrivateKey, signer crypto.Signer) (KeyPair, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return KeyPair{}, errors.Wrap(err, "cannot create certificate")
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return KeyPair{}, errors.Wrap(err, "cannot encode key")
+	}
+	return KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: pemTypeCertificate, Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: pemTypeECPrivateKey, Bytes: kder}),
+	}, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	ca, err := GenerateCA("cool-ca", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA(...): %v", err)
+	}
+	serving, err := GenerateServing(ca, []string{"legion.legion.svc", "legion.legion.svc.cluster.local"}, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateServing(...): %v", err)
+	}
+
+	caCert, err := ca.Certificate()
+	if err != nil {
+		t.Fatalf("ca.Certificate(): %v", err)
+	}
+	c, err := serving.Certificate()
+	if err != nil {
+		t.Fatalf("serving.Certificate(): %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, name := range []string{"legion.legion.svc", "legion.legion.svc.cluster.local"} {
+		if _, err := c.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("c.Verify(%q): %v", name, err)
+		}
+	}
+	if _, err := c.Verify(x509.VerifyOptions{DNSName: "uncool.example.org", Roots: roots}); err == nil {
+		t.Errorf("c.Verify(%q): want error, got nil", "uncool.example.org")
+	}
+
+	if c.NotAfter.After(caCert.NotAfter) {
+		t.Errorf("serving certificate expires at %s, after its certificate authority at %s", c.NotAfter, caCert.NotAfter)
+	}
+
+	if _, err := GenerateServing(ca, nil, time.Hour); err == nil {
+		t.Errorf("GenerateServing(...): want error for no DNS names, got nil")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+)
+
+// Opencensus measurements.
+var (
+	MeasureCertificateExpiry = stats.Int64("cert/expiry", "Unix time at which the served certificate expires.", "s")
+)
+
+// A Reloader serves a TLS certificate and key pair, reloading them whenever
+// they change on disk.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	l        *zap.Logger
+
+	mx      sync.Mutex
+	current atomic.Value // Always a *tls.Certificate.
+}
+
+// An Option configures a Reloader.
+type Option func(r *Reloader)
+
+// WithLogger configures a Reloader to use the supplied logger.
+func WithLogger(l *zap.Logger) Option {
+	return func(r *Reloader) {
+		r.l = l
+	}
+}
+
+// NewReloader returns a Reloader that has loaded the supplied PEM encoded
+// certificate and key files.
+func NewReloader(certFile, keyFile string, o ...Option) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, l: zap.NewNop()}
+	for _, fn := range o {
+		fn(r)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the most recently loaded certificate. It satisfies
+// the signature of crypto/tls.Config's GetCertificate callback.
+func (r *Reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load().(*tls.Certificate), nil
+}
+
+// Reload the certificate and key from disk. The previously loaded certificate
+// continues to be served if the new certificate cannot be loaded.
+func (r *Reloader) Reload() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "cannot load certificate and key")
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "cannot parse certificate")
+	}
+	c.Leaf = leaf
+
+	if old, ok := r.current.Load().(*tls.Certificate); ok && bytes.Equal(old.Certificate[0], c.Certificate[0]) {
+		return nil
+	}
+
+	r.current.Store(&c)
+	r.l.Info("loaded certificate",
+		zap.String("cert", r.certFile),
+		zap.String("subject", leaf.Subject.String()),
+		zap.String("serial", leaf.SerialNumber.String()),
+		zap.Time("expiry", leaf.NotAfter))
+	stats.Record(context.Background(), MeasureCertificateExpiry.M(leaf.NotAfter.Unix()))
+	return nil
+}
+
+// Run watches the certificate and key for changes, reloading them as
+// necessary, until the supplied context is done. The directories containing
+// the certificate and key are watched rather than the files themselves in
+// order to observe the atomic symlink swaps Kubernetes uses to update Secret
+// volumes.
+func (r *Reloader) Run(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create certificate watcher")
+	}
+	defer w.Close()
+
+	for _, dir := range []string{filepath.Dir(r.certFile), filepath.Dir(r.keyFile)} {
+		if err := w.Add(dir); err != nil {
+			return errors.Wrapf(err, "cannot watch %s", dir)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-w.Events:
+			r.l.Debug("certificate changed", zap.String("path", e.Name), zap.String("op", e.Op.String()))
+			if err := r.Reload(); err != nil {
+				r.l.Info("cannot reload certificate; continuing to serve previous certificate", zap.Error(err))
+			}
+		case err := <-w.Errors:
+			r.l.Info("error watching certificate", zap.Error(err))
+		}
+	}
+}
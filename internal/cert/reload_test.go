@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate with the supplied serial
+// number and its key to the supplied files.
+func writeKeyPair(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "legion"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey(...): %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+}
+
+func servedSerial(t *testing.T, r *Reloader) int64 {
+	t.Helper()
+	c, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("r.GetCertificate(): %v", err)
+	}
+	return c.Leaf.SerialNumber.Int64()
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, 1)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader(...): %v", err)
+	}
+	if got, want := servedSerial(t, r), int64(1); got != want {
+		t.Errorf("serial: got %d, want %d", got, want)
+	}
+
+	writeKeyPair(t, certFile, keyFile, 2)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("r.Reload(): %v", err)
+	}
+	if got, want := servedSerial(t, r), int64(2); got != want {
+		t.Errorf("serial: got %d, want %d", got, want)
+	}
+
+	// A corrupt certificate should be rejected in favor of the last good
+	// certificate.
+	if err := ioutil.WriteFile(certFile, []byte("imnotacert"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Errorf("r.Reload(): want error, got nil")
+	}
+	if got, want := servedSerial(t, r), int64(2); got != want {
+		t.Errorf("serial: got %d, want %d", got, want)
+	}
+}
+
+func TestReloadRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, 1)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader(...): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+
+	// Give the watcher a moment to start before rotating the certificate.
+	time.Sleep(100 * time.Millisecond)
+	writeKeyPair(t, certFile, keyFile, 2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, r) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("serial: got %d, want 2", servedSerial(t, r))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("r.Run(): %v", err)
+	}
+}
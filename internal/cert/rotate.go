@@ -0,0 +1,415 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	core "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Defaults for generated certificates.
+const (
+	DefaultValidity   = 90 * 24 * time.Hour
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+)
+
+// caCommonName is the common name of generated certificate authorities.
+const caCommonName = "legion-ca"
+
+// retryInterval is how long a Rotator waits before retrying a failed rotation.
+const retryInterval = time.Minute
+
+// A CA is a certificate authority. Previous contains the PEM encoded
+// certificates of any certificate authorities it replaced. These remain trusted
+// until they expire, so that certificates they signed remain valid while the
+// certificate authority is rolled over.
+type CA struct {
+	KeyPair
+	Previous []byte
+}
+
+// Bundle returns the PEM encoded certificate of the certificate authority,
+// followed by those of any certificate authorities it replaced that have not yet
+// expired.
+func (ca CA) Bundle() []byte {
+	return append(append([]byte{}, ca.Cert...), unexpired(ca.Previous, time.Now())...)
+}
+
+// parseCA returns the certificate authority described by the supplied PEM
+// encoded key and bundle, as returned by CA.Bundle.
+func parseCA(bundle, key []byte) (CA, error) {
+	cert, previous := splitBundle(bundle)
+	if cert == nil {
+		return CA{}, errors.New("bundle contains no PEM encoded certificates")
+	}
+	return CA{KeyPair: KeyPair{Cert: cert, Key: key}, Previous: previous}, nil
+}
+
+// A CAStore persists a certificate authority, so that it may be reused when a
+// Rotator restarts and shared by every Rotator of a webhook.
+type CAStore interface {
+	// Load returns the stored certificate authority, or a CA with no
+	// certificate if none is stored.
+	Load(ctx context.Context) (CA, error)
+
+	// Store replaces the stored certificate authority. It returns a conflict
+	// error if another Rotator stored a certificate authority since it was last
+	// loaded.
+	Store(ctx context.Context, ca CA) error
+}
+
+type caFiles struct {
+	certFile string
+	keyFile  string
+}
+
+// CAFiles returns a CAStore that stores the certificate authority's bundle in
+// the supplied certificate file and its key in the supplied key file.
+func CAFiles(certFile, keyFile string) CAStore {
+	return caFiles{certFile: certFile, keyFile: keyFile}
+}
+
+func (s caFiles) Load(_ context.Context) (CA, error) {
+	bundle, err := ioutil.ReadFile(s.certFile)
+	if os.IsNotExist(err) {
+		return CA{}, nil
+	}
+	if err != nil {
+		return CA{}, errors.Wrapf(err, "cannot read %s", s.certFile)
+	}
+	key, err := ioutil.ReadFile(s.keyFile)
+	if err != nil {
+		return CA{}, errors.Wrapf(err, "cannot read %s", s.keyFile)
+	}
+	ca, err := parseCA(bundle, key)
+	return ca, errors.Wrapf(err, "cannot parse %s", s.certFile)
+}
+
+func (s caFiles) Store(_ context.Context, ca CA) error {
+	// Write the key first; a certificate is only loaded with its key.
+	if err := writeFile(s.keyFile, ca.Key); err != nil {
+		return err
+	}
+	return writeFile(s.certFile, ca.Bundle())
+}
+
+type caSecret struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	resourceVersion string
+}
+
+// CASecret returns a CAStore that stores the certificate authority in the
+// supplied TLS Secret. Rotators that share the Secret share a certificate
+// authority.
+func CASecret(client kubernetes.Interface, namespace, name string) CAStore {
+	return &caSecret{client: client, namespace: namespace, name: name}
+}
+
+func (s *caSecret) Load(ctx context.Context) (CA, error) {
+	sec, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, meta.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		s.resourceVersion = ""
+		return CA{}, nil
+	}
+	if err != nil {
+		return CA{}, errors.Wrapf(err, "cannot get Secret %s/%s", s.namespace, s.name)
+	}
+	s.resourceVersion = sec.GetResourceVersion()
+	ca, err := parseCA(sec.Data[core.TLSCertKey], sec.Data[core.TLSPrivateKeyKey])
+	return ca, errors.Wrapf(err, "cannot parse Secret %s/%s", s.namespace, s.name)
+}
+
+func (s *caSecret) Store(ctx context.Context, ca CA) error {
+	sec := &core.Secret{
+		ObjectMeta: meta.ObjectMeta{Namespace: s.namespace, Name: s.name, ResourceVersion: s.resourceVersion},
+		Type:       core.SecretTypeTLS,
+		Data:       map[string][]byte{core.TLSCertKey: ca.Bundle(), core.TLSPrivateKeyKey: ca.Key},
+	}
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+	var err error
+	if s.resourceVersion == "" {
+		if _, err = secrets.Create(ctx, sec, meta.CreateOptions{}); kerrors.IsAlreadyExists(err) {
+			err = kerrors.NewConflict(core.Resource("secrets"), s.name, err)
+		}
+	} else {
+		_, err = secrets.Update(ctx, sec, meta.UpdateOptions{})
+	}
+	return errors.Wrapf(err, "cannot write Secret %s/%s", s.namespace, s.name)
+}
+
+// A Writer persists a serving certificate and the certificate authority that
+// signed it.
+type Writer func(ctx context.Context, serving KeyPair, ca CA) error
+
+// WriteFiles returns a Writer that writes the serving certificate, followed by
+// the certificate authority's bundle, to the supplied certificate file, and the
+// serving key to the supplied key file. A Reloader will serve the written
+// certificate.
+func WriteFiles(certFile, keyFile string) Writer {
+	return func(_ context.Context, serving KeyPair, ca CA) error {
+		chain := append(append([]byte{}, serving.Cert...), ca.Bundle()...)
+		if err := writeFile(certFile, chain); err != nil {
+			return err
+		}
+		return writeFile(keyFile, serving.Key)
+	}
+}
+
+// writeFile atomically replaces the supplied file.
+func writeFile(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return errors.Wrapf(err, "cannot create temporary file for %s", filename)
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	if _, err := f.Write(data); err != nil {
+		f.Close() // nolint:errcheck,gosec
+		return errors.Wrapf(err, "cannot write %s", f.Name())
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "cannot close %s", f.Name())
+	}
+	return errors.Wrapf(os.Rename(f.Name(), filename), "cannot write %s", filename)
+}
+
+// WriteSecret returns a Writer that creates or updates the supplied TLS Secret,
+// which may be mounted by Legion as its certificate and key. The certificate
+// authority's bundle is written to the Secret's ca.crt key.
+func WriteSecret(client kubernetes.Interface, namespace, name string) Writer {
+	return func(ctx context.Context, serving KeyPair, ca CA) error {
+		data := map[string][]byte{
+			core.TLSCertKey:              append(append([]byte{}, serving.Cert...), ca.Bundle()...),
+			core.TLSPrivateKeyKey:        serving.Key,
+			core.ServiceAccountRootCAKey: ca.Bundle(),
+		}
+		secrets := client.CoreV1().Secrets(namespace)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			s, err := secrets.Get(ctx, name, meta.GetOptions{})
+			if kerrors.IsNotFound(err) {
+				s = &core.Secret{
+					ObjectMeta: meta.ObjectMeta{Namespace: namespace, Name: name},
+					Type:       core.SecretTypeTLS,
+					Data:       data,
+				}
+				_, err = secrets.Create(ctx, s, meta.CreateOptions{})
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			s.Data = data
+			_, err = secrets.Update(ctx, s, meta.UpdateOptions{})
+			return err
+		})
+		return errors.Wrapf(err, "cannot write Secret %s/%s", namespace, name)
+	}
+}
+
+// PatchWebhookCABundle returns a Writer that sets the CA bundle of every
+// webhook of the supplied MutatingWebhookConfiguration to the certificate
+// authority's bundle.
+func PatchWebhookCABundle(client kubernetes.Interface, name string) Writer {
+	return func(ctx context.Context, _ KeyPair, ca CA) error {
+		configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			c, err := configs.Get(ctx, name, meta.GetOptions{})
+			if err != nil {
+				return err
+			}
+			for i := range c.Webhooks {
+				c.Webhooks[i].ClientConfig.CABundle = ca.Bundle()
+			}
+			_, err = configs.Update(ctx, c, meta.UpdateOptions{})
+			return err
+		})
+		return errors.Wrapf(err, "cannot patch CA bundle of MutatingWebhookConfiguration %s", name)
+	}
+}
+
+// A Rotator generates a serving certificate signed by a generated certificate
+// authority, and regenerates it before it expires.
+type Rotator struct {
+	dnsNames   []string
+	validity   time.Duration
+	caValidity time.Duration
+	writers    []Writer
+	store      CAStore
+	l          *zap.Logger
+
+	ca      CA
+	renewAt time.Time
+}
+
+// A RotatorOption configures a Rotator.
+type RotatorOption func(r *Rotator)
+
+// WithRotatorLogger configures a Rotator to use the supplied logger.
+func WithRotatorLogger(l *zap.Logger) RotatorOption {
+	return func(r *Rotator) {
+		r.l = l
+	}
+}
+
+// WithValidity configures how long generated serving certificates are valid.
+func WithValidity(d time.Duration) RotatorOption {
+	return func(r *Rotator) {
+		r.validity = d
+	}
+}
+
+// WithCAValidity configures how long generated certificate authorities are
+// valid.
+func WithCAValidity(d time.Duration) RotatorOption {
+	return func(r *Rotator) {
+		r.caValidity = d
+	}
+}
+
+// WithWriters configures a Rotator to persist each serving certificate it
+// generates using the supplied Writers.
+func WithWriters(w ...Writer) RotatorOption {
+	return func(r *Rotator) {
+		r.writers = append(r.writers, w...)
+	}
+}
+
+// WithCAStore configures a Rotator to reuse the certificate authority stored
+// in the supplied CAStore while it remains valid, and to store any certificate
+// authority it generates. By default a Rotator generates a certificate
+// authority each time it is created.
+func WithCAStore(s CAStore) RotatorOption {
+	return func(r *Rotator) {
+		r.store = s
+	}
+}
+
+// NewRotator returns a Rotator that generates serving certificates for the
+// supplied DNS names.
+func NewRotator(dnsNames []string, o ...RotatorOption) *Rotator {
+	r := &Rotator{dnsNames: dnsNames, validity: DefaultValidity, caValidity: DefaultCAValidity, l: zap.NewNop()}
+	for _, fn := range o {
+		fn(r)
+	}
+	return r
+}
+
+// Rotate generates and writes a new serving certificate. A new certificate
+// authority is generated first if the Rotator has none, or if its certificate
+// authority expires before the new serving certificate would. The certificate
+// authority it replaces remains in the bundle until it expires.
+func (r *Rotator) Rotate(ctx context.Context) error {
+	// Another Rotator may store a certificate authority between our loading
+	// and storing one, in which case we load and use theirs.
+	conflict := func(err error) bool { return kerrors.IsConflict(errors.Cause(err)) }
+	if err := retry.OnError(retry.DefaultRetry, conflict, func() error { return r.ensureCA(ctx) }); err != nil {
+		return err
+	}
+	serving, err := GenerateServing(r.ca.KeyPair, r.dnsNames, r.validity)
+	if err != nil {
+		return errors.Wrap(err, "cannot generate serving certificate")
+	}
+	for _, w := range r.writers {
+		if err := w(ctx, serving, r.ca); err != nil {
+			return err
+		}
+	}
+
+	c, err := serving.Certificate()
+	if err != nil {
+		return err
+	}
+	// Renew once two thirds of the certificate's validity period has elapsed.
+	r.renewAt = c.NotBefore.Add(c.NotAfter.Sub(c.NotBefore) * 2 / 3)
+	r.l.Info("generated certificate",
+		zap.Strings("dnsNames", c.DNSNames),
+		zap.String("serial", c.SerialNumber.String()),
+		zap.Time("expiry", c.NotAfter),
+		zap.Time("renewal", r.renewAt))
+	return nil
+}
+
+// ensureCA loads the stored certificate authority, if any, and generates and
+// stores a certificate authority if necessary.
+func (r *Rotator) ensureCA(ctx context.Context) error {
+	if r.store != nil {
+		ca, err := r.store.Load(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot load certificate authority")
+		}
+		if ca.Cert != nil {
+			r.ca = ca
+		}
+	}
+	if r.ca.Cert != nil {
+		c, err := r.ca.Certificate()
+		if err != nil {
+			return err
+		}
+		if time.Now().Add(r.validity).Before(c.NotAfter) {
+			return nil
+		}
+	}
+	kp, err := GenerateCA(caCommonName, r.caValidity)
+	if err != nil {
+		return errors.Wrap(err, "cannot generate certificate authority")
+	}
+	ca := CA{KeyPair: kp, Previous: r.ca.Bundle()}
+	if r.store != nil {
+		if err := r.store.Store(ctx, ca); err != nil {
+			return errors.Wrap(err, "cannot store certificate authority")
+		}
+	}
+	c, err := ca.Certificate()
+	if err != nil {
+		return err
+	}
+	r.ca = ca
+	r.l.Info("generated certificate authority",
+		zap.String("serial", c.SerialNumber.String()),
+		zap.Time("expiry", c.NotAfter))
+	return nil
+}
+
+// Run rotates the serving certificate before it expires until the supplied
+// context is done. Rotate must have been called at least once before Run.
+func (r *Rotator) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(r.renewAt)):
+			if err := r.Rotate(ctx); err != nil {
+				r.l.Info("cannot rotate certificate; retrying", zap.Error(err), zap.Duration("retry", retryInterval))
+				r.renewAt = time.Now().Add(retryInterval)
+			}
+		}
+	}
+}
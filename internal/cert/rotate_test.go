@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	core "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRotator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := fake.NewSimpleClientset(&admissionregistration.MutatingWebhookConfiguration{
+		ObjectMeta: meta.ObjectMeta{Name: "legion.planet.com"},
+		Webhooks:   []admissionregistration.MutatingWebhook{{Name: "legion.planet.com"}},
+	})
+
+	ctx := context.Background()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	r := NewRotator([]string{"legion.legion.svc"}, WithWriters(
+		WriteFiles(certFile, keyFile),
+		WriteSecret(client, "legion", "legion-tls"),
+		PatchWebhookCABundle(client, "legion.planet.com"),
+	))
+
+	// Each rotation should be written to every Writer, and served by a
+	// Reloader reading the written files.
+	var reloader *Reloader
+	serials := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		if err := r.Rotate(ctx); err != nil {
+			t.Fatalf("r.Rotate(): %v", err)
+		}
+
+		if reloader == nil {
+			reloader, err = NewReloader(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("NewReloader(...): %v", err)
+			}
+		} else if err := reloader.Reload(); err != nil {
+			t.Fatalf("reloader.Reload(): %v", err)
+		}
+		serials[servedSerial(t, reloader)] = true
+
+		bundle, err := CABundle(certFile)
+		if err != nil {
+			t.Fatalf("CABundle(...): %v", err)
+		}
+		if !bytes.Equal(bundle, r.ca.Cert) {
+			t.Errorf("CABundle(...): got %s, want %s", bundle, r.ca.Cert)
+		}
+
+		s, err := client.CoreV1().Secrets("legion").Get(ctx, "legion-tls", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get Secret: %v", err)
+		}
+		if s.Type != core.SecretTypeTLS {
+			t.Errorf("s.Type: got %q, want %q", s.Type, core.SecretTypeTLS)
+		}
+		if !bytes.Equal(s.Data[core.ServiceAccountRootCAKey], r.ca.Cert) {
+			t.Errorf("s.Data[%q]: got %s, want %s", core.ServiceAccountRootCAKey, s.Data[core.ServiceAccountRootCAKey], r.ca.Cert)
+		}
+
+		c, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "legion.planet.com", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get MutatingWebhookConfiguration: %v", err)
+		}
+		if !bytes.Equal(c.Webhooks[0].ClientConfig.CABundle, r.ca.Cert) {
+			t.Errorf("c.Webhooks[0].ClientConfig.CABundle: got %s, want %s", c.Webhooks[0].ClientConfig.CABundle, r.ca.Cert)
+		}
+	}
+	if len(serials) != 2 {
+		t.Errorf("serials: got %v, want two distinct serials", serials)
+	}
+}
+
+func TestRotatorMissingWebhookConfiguration(t *testing.T) {
+	r := NewRotator([]string{"legion.legion.svc"}, WithWriters(PatchWebhookCABundle(fake.NewSimpleClientset(), "legion.planet.com")))
+	if err := r.Rotate(context.Background()); err == nil {
+		t.Errorf("r.Rotate(): want error, got nil")
+	}
+}
+
+func TestRotatorReusesStoredCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	client := fake.NewSimpleClientset()
+
+	cases := map[string]func() CAStore{
+		"Files":  func() CAStore { return CAFiles(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")) },
+		"Secret": func() CAStore { return CASecret(client, "legion", "legion-ca") },
+	}
+
+	for name, store := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// Rotators sharing a store, for example replicas or a restarted
+			// Rotator, share a certificate authority.
+			a := NewRotator([]string{"legion.legion.svc"}, WithCAStore(store()))
+			if err := a.Rotate(ctx); err != nil {
+				t.Fatalf("a.Rotate(): %v", err)
+			}
+			b := NewRotator([]string{"legion.legion.svc"}, WithCAStore(store()))
+			if err := b.Rotate(ctx); err != nil {
+				t.Fatalf("b.Rotate(): %v", err)
+			}
+			if !bytes.Equal(a.ca.Cert, b.ca.Cert) {
+				t.Errorf("b.ca.Cert: got %s, want %s", b.ca.Cert, a.ca.Cert)
+			}
+		})
+	}
+}
+
+func TestRotatorRollsOverCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := CAFiles(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+
+	// The stored certificate authority expires before a new serving
+	// certificate would, so must be replaced.
+	old, err := GenerateCA(caCommonName, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA(...): %v", err)
+	}
+	if err := store.Store(ctx, CA{KeyPair: old}); err != nil {
+		t.Fatalf("store.Store(...): %v", err)
+	}
+
+	client := fake.NewSimpleClientset(&admissionregistration.MutatingWebhookConfiguration{
+		ObjectMeta: meta.ObjectMeta{Name: "legion.planet.com"},
+		Webhooks:   []admissionregistration.MutatingWebhook{{Name: "legion.planet.com"}},
+	})
+	r := NewRotator([]string{"legion.legion.svc"}, WithCAStore(store), WithWriters(PatchWebhookCABundle(client, "legion.planet.com")))
+	if err := r.Rotate(ctx); err != nil {
+		t.Fatalf("r.Rotate(): %v", err)
+	}
+	if bytes.Equal(r.ca.Cert, old.Cert) {
+		t.Fatalf("r.ca.Cert: got the expiring certificate authority, want a new one")
+	}
+
+	// Certificates signed by the old certificate authority remain trusted
+	// until it expires.
+	want := append(append([]byte{}, r.ca.Cert...), old.Cert...)
+	c, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "legion.planet.com", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get MutatingWebhookConfiguration: %v", err)
+	}
+	if !bytes.Equal(c.Webhooks[0].ClientConfig.CABundle, want) {
+		t.Errorf("c.Webhooks[0].ClientConfig.CABundle: got %s, want %s", c.Webhooks[0].ClientConfig.CABundle, want)
+	}
+
+	stored, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("store.Load(): %v", err)
+	}
+	if !bytes.Equal(stored.Bundle(), want) {
+		t.Errorf("stored.Bundle(): got %s, want %s", stored.Bundle(), want)
+	}
+
+	// Expired certificate authorities are dropped from the bundle.
+	if got := unexpired(want, time.Now().Add(2*time.Hour)); !bytes.Equal(got, r.ca.Cert) {
+		t.Errorf("unexpired(...): got %s, want %s", got, r.ca.Cert)
+	}
+}
+
+func TestCASecretConflict(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	ca, err := GenerateCA(caCommonName, DefaultCAValidity)
+	if err != nil {
+		t.Fatalf("GenerateCA(...): %v", err)
+	}
+
+	a, b := CASecret(client, "legion", "legion-ca"), CASecret(client, "legion", "legion-ca")
+	for _, s := range []CAStore{a, b} {
+		if _, err := s.Load(ctx); err != nil {
+			t.Fatalf("s.Load(): %v", err)
+		}
+	}
+	if err := a.Store(ctx, CA{KeyPair: ca}); err != nil {
+		t.Fatalf("a.Store(...): %v", err)
+	}
+	if err := b.Store(ctx, CA{KeyPair: ca}); !kerrors.IsConflict(errors.Cause(err)) {
+		t.Errorf("b.Store(...): got err %v, want conflict", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/imdario/mergo"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+)
+
+// A ContainerTemplate specifies fields that will be merged into each of a
+// pod's existing containers.
+// +k8s:deepcopy-gen=true
+type ContainerTemplate struct {
+	// Selector determines which containers are mutated. All containers are
+	// mutated if the selector is omitted.
+	Selector *ContainerSelector `json:"selector,omitempty"`
+
+	// Template is merged into each selected container. Its name is ignored.
+	Template core.Container `json:"template,omitempty"`
+}
+
+// A ContainerSelector determines which of a pod's containers a
+// ContainerTemplate applies to. A container is selected only if it satisfies
+// all of the selector's criteria.
+// +k8s:deepcopy-gen=true
+type ContainerSelector struct {
+	// Name is a regular expression that must match the container's entire
+	// name.
+	Name string `json:"name,omitempty"`
+
+	// Image is a pattern that must match the container's entire image. The
+	// pattern may include '*', which matches any sequence of characters, and
+	// '?', which matches any single character.
+	Image string `json:"image,omitempty"`
+}
+
+// Selects returns true if the supplied container is selected.
+func (s *ContainerSelector) Selects(c core.Container) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	if s.Name != "" {
+		re, err := regexp.Compile("^(?:" + s.Name + ")$")
+		if err != nil {
+			return false, errors.Wrap(err, "cannot parse container name pattern")
+		}
+		if !re.MatchString(c.Name) {
+			return false, nil
+		}
+	}
+	if s.Image != "" && !globMatch(s.Image, c.Image) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// globMatch returns true if the supplied string matches the supplied pattern.
+// Unlike path.Match '*' matches any sequence of characters, including '/'.
+func globMatch(pattern, s string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\*`, ".*", -1)
+	re = strings.Replace(re, `\?`, ".", -1)
+	return regexp.MustCompile("^" + re + "$").MatchString(s)
+}
+
+// mutateEphemeral mutates each selected ephemeral container in place.
+func (t *ContainerTemplate) mutateEphemeral(ecs []core.EphemeralContainer, mo []func(*mergo.Config)) error {
+	if t == nil {
+		return nil
+	}
+	cs := make([]core.Container, len(ecs))
+	for i := range ecs {
+		cs[i] = core.Container(ecs[i].EphemeralContainerCommon)
+	}
+	if err := t.mutate(cs, mo); err != nil {
+		return err
+	}
+	for i := range ecs {
+		ecs[i].EphemeralContainerCommon = core.EphemeralContainerCommon(cs[i])
+	}
+	return nil
+}
+
+// mutate each selected container in place.
+func (t *ContainerTemplate) mutate(cs []core.Container, mo []func(*mergo.Config)) error {
+	if t == nil {
+		return nil
+	}
+	tmpl := *t.Template.DeepCopy()
+	tmpl.Name = ""
+	for i := range cs {
+		ok, err := t.Selector.Selects(cs[i])
+		if err != nil {
+			return errors.Wrapf(err, "cannot evaluate selector for container %s", cs[i].Name)
+		}
+		if !ok {
+			continue
+		}
+		if err := mergo.Merge(&cs[i], *tmpl.DeepCopy(), mo...); err != nil {
+			return errors.Wrapf(err, "cannot inject container %s", cs[i].Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	core "k8s.io/api/core/v1"
+)
+
+func TestContainerSelectorSelects(t *testing.T) {
+	cases := []struct {
+		name      string
+		s         *ContainerSelector
+		c         core.Container
+		want      bool
+		wantError bool
+	}{
+		{
+			name: "NilSelector",
+			c:    core.Container{Name: "app"},
+			want: true,
+		},
+		{
+			name: "NameMatches",
+			s:    &ContainerSelector{Name: "app|web"},
+			c:    core.Container{Name: "web"},
+			want: true,
+		},
+		{
+			name: "NameMustMatchEntirely",
+			s:    &ContainerSelector{Name: "app"},
+			c:    core.Container{Name: "application"},
+			want: false,
+		},
+		{
+			name:      "InvalidName",
+			s:         &ContainerSelector{Name: "("},
+			c:         core.Container{Name: "app"},
+			wantError: true,
+		},
+		{
+			name: "ImageMatches",
+			s:    &ContainerSelector{Image: "gcr.io/*:v?"},
+			c:    core.Container{Image: "gcr.io/cool/app:v1"},
+			want: true,
+		},
+		{
+			name: "ImageDoesNotMatch",
+			s:    &ContainerSelector{Image: "gcr.io/*"},
+			c:    core.Container{Image: "docker.io/cool/app:v1"},
+			want: false,
+		},
+		{
+			name: "NameMatchesImageDoesNot",
+			s:    &ContainerSelector{Name: "app", Image: "nginx:*"},
+			c:    core.Container{Name: "app", Image: "app:v1"},
+			want: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.s.Selects(tc.c)
+			if err != nil {
+				if !tc.wantError {
+					t.Fatalf("s.Selects(...): %v", err)
+				}
+				return
+			}
+			if tc.wantError {
+				t.Fatalf("s.Selects(...): want error, got nil")
+			}
+			if got != tc.want {
+				t.Errorf("s.Selects(...): got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContainerTemplate(t *testing.T) {
+	proxy := core.EnvVar{Name: "HTTP_PROXY", Value: "http://proxy:3128"}
+	ca := core.VolumeMount{Name: "ca", MountPath: "/etc/ssl/certs"}
+
+	cases := []struct {
+		name string
+		pod  core.PodSpec
+		spec PodMutationSpec
+		want core.PodSpec
+	}{
+		{
+			name: "AllContainers",
+			pod: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Env: []core.EnvVar{{Name: "A", Value: "1"}}},
+				{Name: "sidecar"},
+			}},
+			spec: PodMutationSpec{ContainerTemplate: &ContainerTemplate{
+				Template: core.Container{Name: "ignored", Env: []core.EnvVar{proxy}, VolumeMounts: []core.VolumeMount{ca}},
+			}},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Env: []core.EnvVar{{Name: "A", Value: "1"}, proxy}, VolumeMounts: []core.VolumeMount{ca}},
+				{Name: "sidecar", Env: []core.EnvVar{proxy}, VolumeMounts: []core.VolumeMount{ca}},
+			}},
+		},
+		{
+			name: "SelectedContainers",
+			pod: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "gcr.io/cool/app:v1"},
+				{Name: "sidecar", Image: "docker.io/envoy:v1"},
+			}},
+			spec: PodMutationSpec{ContainerTemplate: &ContainerTemplate{
+				Selector: &ContainerSelector{Image: "gcr.io/*"},
+				Template: core.Container{Env: []core.EnvVar{proxy}},
+			}},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "gcr.io/cool/app:v1", Env: []core.EnvVar{proxy}},
+				{Name: "sidecar", Image: "docker.io/envoy:v1"},
+			}},
+		},
+		{
+			name: "InitContainers",
+			pod: core.PodSpec{
+				InitContainers: []core.Container{{Name: "init"}},
+				Containers:     []core.Container{{Name: "app"}},
+			},
+			spec: PodMutationSpec{InitContainerTemplate: &ContainerTemplate{
+				Template: core.Container{Env: []core.EnvVar{proxy}},
+			}},
+			want: core.PodSpec{
+				InitContainers: []core.Container{{Name: "init", Env: []core.EnvVar{proxy}}},
+				Containers:     []core.Container{{Name: "app"}},
+			},
+		},
+		{
+			name: "IncludesContainersAddedByTemplate",
+			pod:  core.PodSpec{Containers: []core.Container{{Name: "app"}}},
+			spec: PodMutationSpec{
+				Template: PodMutationTemplate{Spec: core.PodSpec{Containers: []core.Container{{Name: "sidecar"}}}},
+				ContainerTemplate: &ContainerTemplate{
+					Template: core.Container{Env: []core.EnvVar{proxy}},
+				},
+			},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Env: []core.EnvVar{proxy}},
+				{Name: "sidecar", Env: []core.EnvVar{proxy}},
+			}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &core.Pod{Spec: tc.pod}
+			m := PodMutation{Spec: tc.spec}
+			if err := m.mutate(pod); err != nil {
+				t.Fatalf("m.mutate(...): %v", err)
+			}
+			if diff := deep.Equal(pod.Spec, tc.want); diff != nil {
+				t.Errorf("m.mutate(...): got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// A FileError is a problem with a configuration file.
+type FileError struct {
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.File + ": " + e.Err.Error()
+}
+
+// LoadPodMutations loads PodMutations from the supplied path, which may be
+// either a file or a directory. Every file in a directory is loaded, excluding
+// hidden files such as those Kubernetes uses to atomically update ConfigMap
+// volumes. The returned PodMutations are validated and sorted by priority.
+// Each file is decoded using the supplied DecodeOptions. Every file is decoded
+// and validated even if some are invalid; each problem found is returned as a
+// *FileError.
+func LoadPodMutations(path string, do ...DecodeOption) (PodMutations, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := []error{}
+	fieldErrs := func(f string, fe field.ErrorList) {
+		for _, e := range fe {
+			errs = append(errs, &FileError{File: f, Err: e})
+		}
+	}
+
+	pms := make(PodMutations, 0, len(files))
+	source := map[string]string{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			errs = append(errs, &FileError{File: f, Err: errors.Wrap(err, "cannot read file")})
+			continue
+		}
+		pm, unknown, err := decodePodMutation(data, do...)
+		if err != nil {
+			errs = append(errs, &FileError{File: f, Err: err})
+			continue
+		}
+		fieldErrs(f, unknown)
+		fieldErrs(f, ValidatePodMutation(pm))
+
+		for _, other := range pms {
+			fieldErrs(f, validateNoConflicts(other, pm))
+		}
+		if sf, ok := source[pm.GetName()]; ok {
+			fieldErrs(f, field.ErrorList{{
+				Type:     field.ErrorTypeDuplicate,
+				Field:    "metadata.name",
+				BadValue: pm.GetName(),
+				Detail:   "also defined in " + sf,
+			}})
+			continue
+		}
+		source[pm.GetName()] = f
+		pms = append(pms, pm)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Wrap(utilerrors.NewAggregate(errs), "invalid PodMutations")
+	}
+	sort.Stable(ByPriority(pms))
+	return pms, nil
+}
+
+// configFiles returns the configuration files at the supplied path, in lexical
+// order.
+func configFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot stat %s", path)
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read directory %s", path)
+	}
+	files := []string{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		f := filepath.Join(path, e.Name())
+
+		// ConfigMap volume files are symlinks, so we must stat them to
+		// determine whether they point to a regular file.
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot stat %s", f)
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
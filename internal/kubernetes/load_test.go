@@ -0,0 +1,231 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const podMutationYAMLFmt = `
+---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: %s
+spec:
+  priority: %d
+`
+
+func names(pms PodMutations) []string {
+	n := []string{}
+	for _, pm := range pms {
+		n = append(n, pm.GetName())
+	}
+	return n
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("os.MkdirAll(...): %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(...): %v", err)
+	}
+}
+
+func TestLoadPodMutations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A plain directory of PodMutations.
+	writeFile(t, filepath.Join(dir, "plain", "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "late", 10))
+	writeFile(t, filepath.Join(dir, "plain", "b.yaml"), fmt.Sprintf(podMutationYAMLFmt, "early", -10))
+	writeFile(t, filepath.Join(dir, "plain", "c.yaml"), fmt.Sprintf(podMutationYAMLFmt, "default", 0))
+	writeFile(t, filepath.Join(dir, "plain", ".hidden.yaml"), "imnotapodmutation")
+
+	// A directory laid out like a Kubernetes ConfigMap volume.
+	writeFile(t, filepath.Join(dir, "configmap", "..2018_12_31", "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cool", 0))
+	if err := os.Symlink("..2018_12_31", filepath.Join(dir, "configmap", "..data")); err != nil {
+		t.Fatalf("os.Symlink(...): %v", err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "a.yaml"), filepath.Join(dir, "configmap", "a.yaml")); err != nil {
+		t.Fatalf("os.Symlink(...): %v", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "invalid", "a.yaml"), "imnotapodmutation")
+
+	// Two individually valid PodMutations that share a name.
+	writeFile(t, filepath.Join(dir, "duplicate", "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cool", 0))
+	writeFile(t, filepath.Join(dir, "duplicate", "b.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cool", 10))
+
+	cases := []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "File",
+			path: filepath.Join(dir, "plain", "a.yaml"),
+			want: []string{"late"},
+		},
+		{
+			name: "Directory",
+			path: filepath.Join(dir, "plain"),
+			want: []string{"early", "default", "late"},
+		},
+		{
+			name: "ConfigMapDirectory",
+			path: filepath.Join(dir, "configmap"),
+			want: []string{"cool"},
+		},
+		{
+			name:    "InvalidFile",
+			path:    filepath.Join(dir, "invalid"),
+			wantErr: true,
+		},
+		{
+			name:    "DuplicateNames",
+			path:    filepath.Join(dir, "duplicate"),
+			wantErr: true,
+		},
+		{
+			name:    "MissingFile",
+			path:    filepath.Join(dir, "missing"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pms, err := LoadPodMutations(tc.path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("LoadPodMutations(%q): want error, got nil", tc.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadPodMutations(%q): %v", tc.path, err)
+			}
+			if diff := deep.Equal(names(pms), tc.want); diff != nil {
+				t.Errorf("got != want:\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestLoadPodMutationsReportsEveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "a.yaml"), `
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: a
+spec:
+  strategy:
+    overwite: true
+  template:
+    spec:
+      containers:
+      - name: cool
+`)
+	writeFile(t, filepath.Join(dir, "b.yaml"), `
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: b
+spec:
+  template:
+    spec:
+      containers:
+      - name: NotCool
+`)
+	writeFile(t, filepath.Join(dir, "c.yaml"), "imnotapodmutation")
+
+	// Shares a name with a.yaml, and a container with b.yaml at the same
+	// priority.
+	writeFile(t, filepath.Join(dir, "d.yaml"), `
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: a
+spec:
+  template:
+    spec:
+      containers:
+      - name: NotCool
+        image: cool
+`)
+
+	want := []string{
+		filepath.Join(dir, "a.yaml") + ": spec.strategy.overwite",
+		filepath.Join(dir, "a.yaml") + ": spec.template.spec.containers[0].image",
+		filepath.Join(dir, "b.yaml") + ": spec.template.spec.containers[0].image",
+		filepath.Join(dir, "b.yaml") + ": spec.template.spec.containers[0].name",
+		filepath.Join(dir, "c.yaml") + ": cannot decode PodMutation",
+		filepath.Join(dir, "d.yaml") + ": metadata.name",
+		filepath.Join(dir, "d.yaml") + ": spec.template.spec.containers[0].name",
+		filepath.Join(dir, "d.yaml") + ": spec.template.spec.containers[0].name",
+	}
+
+	_, err = LoadPodMutations(dir)
+	agg, ok := errors.Cause(err).(utilerrors.Aggregate)
+	if !ok {
+		t.Fatalf("LoadPodMutations(%q): want aggregate error, got %v", dir, err)
+	}
+	got := []string{}
+	duplicate := fmt.Sprintf(`%s: metadata.name: Duplicate value: "a": also defined in %s`, filepath.Join(dir, "d.yaml"), filepath.Join(dir, "a.yaml"))
+	found := false
+	for _, e := range agg.Errors() {
+		fe, ok := e.(*FileError)
+		if !ok {
+			t.Fatalf("LoadPodMutations(%q): want *FileError, got %T", dir, e)
+		}
+		// Only the file and field path (or error) are compared; the
+		// descriptions of each problem are tested elsewhere.
+		p := strings.SplitN(fe.Err.Error(), ":", 2)[0]
+		got = append(got, fe.File+": "+p)
+		found = found || fe.Error() == duplicate
+	}
+	if !found {
+		t.Errorf("LoadPodMutations(%q): want error %q", dir, duplicate)
+	}
+	sort.Strings(got)
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("LoadPodMutations(%q): got != want: %v", dir, diff)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultMarkerAnnotation is the default annotation with which Legion marks
+// the pods it has mutated.
+const DefaultMarkerAnnotation = "legion.planet.com/mutation"
+
+// AppliedAnnotation returns the annotation in which Legion records the
+// PodMutations it applied to a pod marked with the supplied annotation.
+func AppliedAnnotation(marker string) string {
+	return marker + "-applied"
+}
+
+// ValidateMarkerAnnotation returns an error if the supplied marker annotation,
+// or the annotation in which applied PodMutations are recorded, is not a valid
+// annotation key.
+func ValidateMarkerAnnotation(marker string) error {
+	for _, k := range []string{marker, AppliedAnnotation(marker)} {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return errors.Errorf("invalid annotation %q: %s", k, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// appliedPodMutations maps the identifiers of the PodMutations applied to a
+// pod to the hashes of their specs.
+type appliedPodMutations map[string]string
+
+// parseApplied parses the value of an applied annotation, which is a comma
+// separated list of id=hash pairs. Malformed pairs are ignored.
+func parseApplied(v string) appliedPodMutations {
+	a := appliedPodMutations{}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		a[kv[0]] = kv[1]
+	}
+	return a
+}
+
+// String encodes the applied PodMutations in the format read by parseApplied.
+func (a appliedPodMutations) String() string {
+	pairs := make([]string, 0, len(a))
+	for id, hash := range a {
+		pairs = append(pairs, id+"="+hash)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// podMutationID identifies the supplied PodMutation. PodMutations loaded from
+// files are identified by name. Custom resources are identified by kind and
+// name, with the namespace of namespaced PodMutations between the two.
+func podMutationID(m PodMutation) string {
+	switch m.source {
+	case sourcePodMutation:
+		return string(m.source) + "/" + m.GetNamespace() + "/" + m.GetName()
+	case sourceClusterPodMutation:
+		return string(m.source) + "/" + m.GetName()
+	default:
+		return m.GetName()
+	}
+}
+
+// hashPodMutationSpec returns a hash of the supplied PodMutationSpec, prior to
+// rendering its templates.
+func hashPodMutationSpec(s PodMutationSpec) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode PodMutation spec as JSON")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16], nil
+}
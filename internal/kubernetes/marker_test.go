@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/go-test/deep"
+	admission "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseApplied(t *testing.T) {
+	cases := []struct {
+		name string
+		v    string
+		want appliedPodMutations
+	}{
+		{name: "Empty", v: "", want: appliedPodMutations{}},
+		{name: "Valid", v: "b=2,ns/a=1", want: appliedPodMutations{"ns/a": "1", "b": "2"}},
+		{name: "Malformed", v: "a=1,,b, =3", want: appliedPodMutations{"a": "1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseApplied(tc.v)
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("parseApplied(%q): got != want: %v", tc.v, diff)
+			}
+		})
+	}
+}
+
+func TestAppliedString(t *testing.T) {
+	a := appliedPodMutations{"b": "2", "ns/a": "1"}
+	if got, want := a.String(), "b=2,ns/a=1"; got != want {
+		t.Errorf("a.String(): got %q, want %q", got, want)
+	}
+}
+
+func TestPodMutationID(t *testing.T) {
+	named := meta.ObjectMeta{Name: "cool", Namespace: "coolnamespace"}
+	cases := []struct {
+		name string
+		m    PodMutation
+		want string
+	}{
+		{name: "File", m: PodMutation{ObjectMeta: named}, want: "cool"},
+		{name: "PodMutation", m: PodMutation{ObjectMeta: named, source: sourcePodMutation}, want: "PodMutation/coolnamespace/cool"},
+		{name: "ClusterPodMutation", m: PodMutation{ObjectMeta: meta.ObjectMeta{Name: "cool"}, source: sourceClusterPodMutation}, want: "ClusterPodMutation/cool"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := podMutationID(tc.m); got != tc.want {
+				t.Errorf("podMutationID(...): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateMarkerAnnotation(t *testing.T) {
+	cases := []struct {
+		marker  string
+		wantErr bool
+	}{
+		{marker: DefaultMarkerAnnotation},
+		{marker: "not cool", wantErr: true},
+		{marker: "cool.planet.com/" + string(bytes.Repeat([]byte("a"), 60)), wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.marker, func(t *testing.T) {
+			err := ValidateMarkerAnnotation(tc.marker)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ValidateMarkerAnnotation(%q): got err %v, want error %t", tc.marker, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPodMutationsPatchMarker(t *testing.T) {
+	annotate := PodMutation{
+		ObjectMeta: meta.ObjectMeta{Name: "annotate"},
+		Spec: PodMutationSpec{
+			Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "true"}}},
+		},
+	}
+	hash, err := hashPodMutationSpec(annotate.Spec)
+	if err != nil {
+		t.Fatalf("hashPodMutationSpec(...): %v", err)
+	}
+	marked := func(applied string) core.Pod {
+		p := coolPod.DeepCopy()
+		p.Annotations = map[string]string{"cool": "true", "marker": MutationDone, "marker-applied": applied}
+		return *p
+	}
+
+	cases := []struct {
+		name string
+		pod  core.Pod
+		want string
+	}{
+		{
+			name: "Unmarked",
+			pod:  coolPod,
+			want: fmt.Sprintf(`[{"op":"add","path":"/metadata/annotations/marker","value":"mutated"},{"op":"add","path":"/metadata/annotations/marker-applied","value":"annotate=%s"},{"op":"add","path":"/metadata/annotations/supercool","value":"true"}]`, hash),
+		},
+		{
+			name: "AlreadyApplied",
+			pod:  marked("annotate=" + hash),
+			want: `[]`,
+		},
+		{
+			name: "SpecChanged",
+			pod:  marked("annotate=outdated,other=cool"),
+			want: fmt.Sprintf(`[{"op":"replace","path":"/metadata/annotations/marker-applied","value":"annotate=%s,other=cool"},{"op":"add","path":"/metadata/annotations/supercool","value":"true"}]`, hash),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := PodMutations{annotate}.Patch(PodReview{Pod: tc.pod, Marker: "marker"})
+			if err != nil {
+				t.Fatalf("Patch(...): %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Patch(...):\ngot:  %s\nwant: %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReviewMarkerDisabled(t *testing.T) {
+	p := coolPod.DeepCopy()
+	p.Annotations = map[string]string{"marker": MutationDisabled}
+	b := &bytes.Buffer{}
+	serializer.Encode(p, b)
+
+	rp := &recordingPatcher{}
+	got := NewPodMutator(rp, WithMarker("marker")).Review(&admission.AdmissionRequest{
+		Resource: resourcePod,
+		Object:   runtime.RawExtension{Raw: b.Bytes()},
+	})
+	if diff := deep.Equal(got, &admission.AdmissionResponse{Allowed: true}); diff != nil {
+		t.Errorf("got != want: %v", diff)
+	}
+	if len(rp.reviews) != 0 {
+		t.Errorf("rp.reviews: got %d reviews, want 0", len(rp.reviews))
+	}
+}
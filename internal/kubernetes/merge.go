@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/imdario/mergo"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// A mergeKeyFunc returns the key by which an element of an array is merged.
+type mergeKeyFunc func(v reflect.Value) string
+
+// mergeKeys specifies the arrays that are merged by key rather than by
+// position, and how to derive the key of each of their elements. The keys
+// match those used by Kubernetes strategic merge patches where possible.
+var mergeKeys = map[reflect.Type]mergeKeyFunc{
+	reflect.TypeOf([]core.Container{}): func(v reflect.Value) string {
+		return v.Interface().(core.Container).Name
+	},
+	reflect.TypeOf([]core.Volume{}): func(v reflect.Value) string {
+		return v.Interface().(core.Volume).Name
+	},
+	reflect.TypeOf([]core.EnvVar{}): func(v reflect.Value) string {
+		return v.Interface().(core.EnvVar).Name
+	},
+	reflect.TypeOf([]core.VolumeMount{}): func(v reflect.Value) string {
+		return v.Interface().(core.VolumeMount).MountPath
+	},
+	reflect.TypeOf([]core.ContainerPort{}): func(v reflect.Value) string {
+		p := v.Interface().(core.ContainerPort)
+		if p.Protocol == "" {
+			p.Protocol = core.ProtocolTCP
+		}
+		return fmt.Sprintf("%d/%s", p.ContainerPort, p.Protocol)
+	},
+	// Tolerations have no strategic merge key. We consider tolerations of the
+	// same key and effect to be the same toleration.
+	reflect.TypeOf([]core.Toleration{}): func(v reflect.Value) string {
+		t := v.Interface().(core.Toleration)
+		return fmt.Sprintf("%s:%s", t.Key, t.Effect)
+	},
+}
+
+// keyedMerge is a mergo transformer that merges arrays by key.
+type keyedMerge struct {
+	mo []func(*mergo.Config)
+}
+
+// mergeOptions returns the mergo options for the supplied strategy.
+func mergeOptions(s PodMutationStrategy) []func(*mergo.Config) {
+	km := &keyedMerge{}
+	mo := []func(*mergo.Config){mergo.WithTransformers(km)}
+	if s.Overwrite {
+		mo = append(mo, mergo.WithOverride)
+	}
+	if s.Append {
+		mo = append(mo, mergo.WithAppendSlice)
+	}
+	km.mo = mo
+	return mo
+}
+
+func (km *keyedMerge) Transformer(t reflect.Type) func(dst, src reflect.Value) error {
+	key, ok := mergeKeys[t]
+	if !ok {
+		return nil
+	}
+	return func(dst, src reflect.Value) error {
+		if !dst.CanSet() {
+			return nil
+		}
+
+		merged := reflect.AppendSlice(reflect.MakeSlice(t, 0, dst.Len()+src.Len()), dst)
+		index := map[string]int{}
+		for i := 0; i < merged.Len(); i++ {
+			index[key(merged.Index(i))] = i
+		}
+
+		for i := 0; i < src.Len(); i++ {
+			s := src.Index(i)
+			k := key(s)
+			j, ok := index[k]
+			if !ok {
+				index[k] = merged.Len()
+				merged = reflect.Append(merged, s)
+				continue
+			}
+			if err := mergo.Merge(merged.Index(j).Addr().Interface(), s.Interface(), km.mo...); err != nil {
+				return errors.Wrapf(err, "cannot merge %s %s", t.Elem().Name(), k)
+			}
+		}
+
+		dst.Set(merged)
+		return nil
+	}
+}
+
+// strategicMerge applies the supplied template to the supplied pod in place as
+// a Kubernetes strategic merge patch.
+func strategicMerge(pod *core.Pod, t PodMutationTemplate) error {
+	patch := t.raw
+	if patch == nil {
+		// Templates that were not decoded are encoded with explicit nulls for
+		// unset fields, which a strategic merge patch would interpret as a
+		// request to delete said fields.
+		var err error
+		if patch, err = withoutNulls(t); err != nil {
+			return errors.Wrap(err, "cannot encode template as JSON")
+		}
+	}
+
+	pb, err := json.Marshal(pod)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode pod as JSON")
+	}
+	merged, err := strategicpatch.StrategicMergePatch(pb, patch, core.Pod{})
+	if err != nil {
+		return errors.Wrap(err, "cannot apply strategic merge patch")
+	}
+
+	out := core.Pod{}
+	if err := json.Unmarshal(merged, &out); err != nil {
+		return errors.Wrap(err, "cannot decode patched pod")
+	}
+	*pod = out
+	return nil
+}
+
+// withoutNulls encodes the supplied value as JSON, omitting null values.
+func withoutNulls(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return json.Marshal(dropNulls(m))
+}
+
+func dropNulls(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = dropNulls(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = dropNulls(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	core "k8s.io/api/core/v1"
+)
+
+func TestKeyedMerge(t *testing.T) {
+	cases := []struct {
+		name     string
+		pod      core.PodSpec
+		strategy PodMutationStrategy
+		template core.PodSpec
+		want     core.PodSpec
+	}{
+		{
+			name: "MergeContainerByName",
+			pod: core.PodSpec{Containers: []core.Container{
+				{Name: "sidecar", Image: "sidecar:1"},
+				{Name: "app", Image: "app:1"},
+			}},
+			strategy: PodMutationStrategy{Append: true},
+			template: core.PodSpec{Containers: []core.Container{
+				{Name: "app", WorkingDir: "/app"},
+			}},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "sidecar", Image: "sidecar:1"},
+				{Name: "app", Image: "app:1", WorkingDir: "/app"},
+			}},
+		},
+		{
+			name: "AppendContainerWithNewName",
+			pod: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "app:1"},
+			}},
+			template: core.PodSpec{Containers: []core.Container{
+				{Name: "sidecar", Image: "sidecar:1"},
+			}},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "app:1"},
+				{Name: "sidecar", Image: "sidecar:1"},
+			}},
+		},
+		{
+			name: "DoNotOverwriteContainerFields",
+			pod: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:1"},
+			}},
+			template: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:2"},
+			}},
+			want: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:1"},
+			}},
+		},
+		{
+			name: "OverwriteContainerFields",
+			pod: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:1"},
+			}},
+			strategy: PodMutationStrategy{Overwrite: true},
+			template: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:2"},
+			}},
+			want: core.PodSpec{InitContainers: []core.Container{
+				{Name: "init", Image: "init:2"},
+			}},
+		},
+		{
+			name: "MergeNestedEnvVolumeMountsAndPorts",
+			pod: core.PodSpec{Containers: []core.Container{{
+				Name:         "app",
+				Env:          []core.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}},
+				VolumeMounts: []core.VolumeMount{{Name: "data", MountPath: "/data"}},
+				Ports:        []core.ContainerPort{{ContainerPort: 80}},
+			}}},
+			strategy: PodMutationStrategy{Overwrite: true},
+			template: core.PodSpec{Containers: []core.Container{{
+				Name:         "app",
+				Env:          []core.EnvVar{{Name: "B", Value: "3"}, {Name: "C", Value: "4"}},
+				VolumeMounts: []core.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}, {Name: "tmp", MountPath: "/tmp"}},
+				Ports:        []core.ContainerPort{{Name: "http", ContainerPort: 80, Protocol: core.ProtocolTCP}, {ContainerPort: 53, Protocol: core.ProtocolUDP}},
+			}}},
+			want: core.PodSpec{Containers: []core.Container{{
+				Name:         "app",
+				Env:          []core.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "3"}, {Name: "C", Value: "4"}},
+				VolumeMounts: []core.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}, {Name: "tmp", MountPath: "/tmp"}},
+				Ports:        []core.ContainerPort{{Name: "http", ContainerPort: 80, Protocol: core.ProtocolTCP}, {ContainerPort: 53, Protocol: core.ProtocolUDP}},
+			}}},
+		},
+		{
+			name: "MergeVolumesByName",
+			pod: core.PodSpec{Volumes: []core.Volume{
+				{Name: "data", VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}}},
+			}},
+			template: core.PodSpec{Volumes: []core.Volume{
+				{Name: "data", VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{Medium: core.StorageMediumMemory}}},
+				{Name: "tmp", VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}}},
+			}},
+			want: core.PodSpec{Volumes: []core.Volume{
+				{Name: "data", VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{Medium: core.StorageMediumMemory}}},
+				{Name: "tmp", VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}}},
+			}},
+		},
+		{
+			name: "MergeTolerationsByKeyAndEffect",
+			pod: core.PodSpec{Tolerations: []core.Toleration{
+				{Key: "dedicated", Operator: core.TolerationOpEqual, Value: "a", Effect: core.TaintEffectNoSchedule},
+			}},
+			strategy: PodMutationStrategy{Overwrite: true},
+			template: core.PodSpec{Tolerations: []core.Toleration{
+				{Key: "dedicated", Operator: core.TolerationOpEqual, Value: "b", Effect: core.TaintEffectNoSchedule},
+				{Key: "dedicated", Operator: core.TolerationOpEqual, Value: "b", Effect: core.TaintEffectNoExecute},
+			}},
+			want: core.PodSpec{Tolerations: []core.Toleration{
+				{Key: "dedicated", Operator: core.TolerationOpEqual, Value: "b", Effect: core.TaintEffectNoSchedule},
+				{Key: "dedicated", Operator: core.TolerationOpEqual, Value: "b", Effect: core.TaintEffectNoExecute},
+			}},
+		},
+		{
+			name: "EmptyPod",
+			template: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "app:1"},
+			}},
+			want: core.PodSpec{Containers: []core.Container{
+				{Name: "app", Image: "app:1"},
+			}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &core.Pod{Spec: tc.pod}
+			m := PodMutation{Spec: PodMutationSpec{Strategy: tc.strategy, Template: PodMutationTemplate{Spec: tc.template}}}
+			if err := m.mutate(pod); err != nil {
+				t.Fatalf("m.mutate(...): %v", err)
+			}
+			if diff := deep.Equal(pod.Spec, tc.want); diff != nil {
+				t.Errorf("m.mutate(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestStrategicMerge(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		want     []byte
+	}{
+		{
+			name: "MergeContainerByName",
+			template: `
+      spec:
+        containers:
+        - name: coolcontainer
+          args: ["-extremely"]
+        - name: sidecar
+          image: sidecar:1`,
+			want: []byte(`[{"op":"replace","path":"/spec/containers/0/args/0","value":"-extremely"},{"op":"add","path":"/spec/containers/1","value":{"image":"sidecar:1","name":"sidecar","resources":{}}}]`),
+		},
+		{
+			name: "DeleteContainer",
+			template: `
+      spec:
+        containers:
+        - name: coolcontainer
+          $patch: delete`,
+			want: []byte(`[{"op":"remove","path":"/spec/containers/0"}]`),
+		},
+		{
+			name: "DeleteAnnotation",
+			template: `
+      metadata:
+        annotations:
+          cool: null
+        labels:
+          injected: "true"`,
+			want: []byte(`[{"op":"remove","path":"/metadata/annotations"},{"op":"add","path":"/metadata/labels/injected","value":"true"}]`),
+		},
+		{
+			name: "RetainKeys",
+			template: `
+      spec:
+        containers:
+        - name: coolcontainer
+          $retainKeys: [name, image]
+          image: coolimage:cooler`,
+			want: []byte(`[{"op":"remove","path":"/spec/containers/0/args"},{"op":"remove","path":"/spec/containers/0/command"},{"op":"replace","path":"/spec/containers/0/image","value":"coolimage:cooler"}]`),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := DecodePodMutation([]byte(`---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: strategic
+spec:
+  strategy:
+    type: StrategicMerge
+  template:` + tc.template))
+			if err != nil {
+				t.Fatalf("DecodePodMutation(...): %v", err)
+			}
+			got, err := m.Patch(PodReview{Pod: coolPod})
+			if err != nil {
+				t.Fatalf("m.Patch(...): %v", err)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("m.Patch(...): got != want:\n  got:  %s\n  want: %s\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStrategicMergeUndecodedTemplate(t *testing.T) {
+	m := PodMutation{Spec: PodMutationSpec{
+		Strategy: PodMutationStrategy{Type: StrategicMergeStrategy},
+		Template: PodMutationTemplate{Spec: core.PodSpec{NodeSelector: map[string]string{"cool": "true"}}},
+	}}
+	want := []byte(`[{"op":"add","path":"/spec/nodeSelector","value":{"cool":"true"}}]`)
+
+	got, err := m.Patch(PodReview{Pod: coolPod})
+	if err != nil {
+		t.Fatalf("m.Patch(...): %v", err)
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("m.Patch(...): got != want:\n  got:  %s\n  want: %s\n", got, want)
+	}
+}
@@ -20,7 +20,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/appscode/jsonpatch"
 	"github.com/imdario/mergo"
@@ -28,21 +32,35 @@ import (
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
-	admission "k8s.io/api/admission/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	authentication "k8s.io/api/authentication/v1"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
 	runtimejson "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
-// Annotation values controlling injection.
+// Values of the marker annotation. Legion marks the pods it mutates as
+// mutated, and does not mutate pods marked as disabled.
 const (
 	MutationDone     = "mutated"
 	MutationDisabled = "disabled"
 )
 
+// subResourceEphemeralContainers is the pod subresource used to add ephemeral
+// containers to running pods.
+const subResourceEphemeralContainers = "ephemeralcontainers"
+
+// kindEphemeralContainers is the kind of object sent to the ephemeralcontainers
+// subresource by Kubernetes versions prior to 1.22.
+const kindEphemeralContainers = "EphemeralContainers"
+
 var (
 	jsonPatch   = admission.PatchTypeJSONPatch
 	resourcePod = meta.GroupVersionResource{Version: "v1", Resource: "pods"}
@@ -51,23 +69,98 @@ var (
 
 const (
 	tagResultMutated = "mutated"
+	tagResultAudited = "audited"
 	tagResultIgnored = "ignored"
 	tagResultError   = "error"
+	tagResultSuccess = "success"
 )
 
 // Opencensus measurements.
 var (
-	MeasurePodsReviewed = stats.Int64("patch/pods_reviewed", "Number of pods reviewed.", stats.UnitDimensionless)
+	MeasurePodsReviewed  = stats.Int64("patch/pods_reviewed", "Number of pods reviewed.", stats.UnitDimensionless)
+	MeasurePodsValidated = stats.Int64("patch/pods_validated", "Number of pods validated.", stats.UnitDimensionless)
+	MeasurePodsAudited   = stats.Int64("patch/pods_audited", "Number of pods PodMutations in audit mode would have mutated.", stats.UnitDimensionless)
 
 	TagKind, _      = tag.NewKey("kind")
 	TagNamespace, _ = tag.NewKey("namespace")
 	TagName, _      = tag.NewKey("name")
 	TagResult, _    = tag.NewKey("result")
+	TagDryRun, _    = tag.NewKey("dry_run")
 )
 
-// A Patcher generates an RFC6902 JSON patch for the supplied pod.
+// A PodReview is a pod under admission review.
+type PodReview struct {
+	// Pod under review.
+	Pod core.Pod
+
+	// Namespace in which the pod is being created. Pods do not always specify
+	// their namespace at admission time.
+	Namespace string
+
+	// NamespaceLabels are the labels of the namespace in which the pod is
+	// being created, or nil if they are unknown.
+	NamespaceLabels labels.Set
+
+	// namespaceLabels determines the labels of the namespace when they are
+	// first needed, if NamespaceLabels is nil.
+	namespaceLabels func() (labels.Set, error)
+
+	// UserInfo of the user that made the admission request.
+	UserInfo authentication.UserInfo
+
+	// Operation being reviewed. Reviews without an operation are treated as
+	// pod creations.
+	Operation admission.Operation
+
+	// SubResource being reviewed, if any. Only the ephemeralcontainers
+	// subresource is supported.
+	SubResource string
+
+	// OldPod is the pod prior to an update, or nil.
+	OldPod *core.Pod
+
+	// Marker is the annotation with which mutated pods are marked, if any.
+	// PodMutations recorded as applied to a marked pod are not reapplied
+	// unless their spec has changed.
+	Marker string
+
+	// Provenance is the annotation in which the applied PodMutations and the
+	// paths they modified are recorded, if any.
+	Provenance string
+
+	// recordProvenance is called with the provenance recorded in the
+	// Provenance annotation, if any.
+	recordProvenance func(Provenance)
+}
+
+// namespaceLabelSet returns the labels of the namespace in which the pod is
+// being created, or nil if they are unknown.
+func (r PodReview) namespaceLabelSet() (labels.Set, error) {
+	if r.NamespaceLabels != nil || r.namespaceLabels == nil {
+		return r.NamespaceLabels, nil
+	}
+	return r.namespaceLabels()
+}
+
+// errUnknownNamespace indicates that the labels of a pod's namespace could not
+// be determined, and that the pod should be rejected.
+type errUnknownNamespace struct {
+	error
+}
+
+// A Patcher generates an RFC6902 JSON patch for the supplied pod. Legion's
+// webhook is registered as having no side effects, and is sent pods that will
+// not be persisted (dry runs), so Patchers must not cause side effects outside
+// Legion, for example by calling external services.
 type Patcher interface {
-	Patch(core.Pod) ([]byte, error)
+	Patch(PodReview) ([]byte, error)
+}
+
+// An Auditor generates an RFC6902 JSON patch describing how the supplied pod
+// would be mutated if PodMutations in audit mode were enforced. The patch is
+// nil if there are no PodMutations in audit mode.
+type Auditor interface {
+	Audit(PodReview) ([]byte, error)
 }
 
 // A PodMutation specifies how a pod will be mutated.
@@ -77,13 +170,63 @@ type PodMutation struct {
 	meta.TypeMeta   `json:",inline"`
 	meta.ObjectMeta `json:"metadata,omitempty"`
 	Spec            PodMutationSpec `json:"spec,omitempty"`
+
+	source podMutationSource
 }
 
+// A podMutationSource is the kind of custom resource a PodMutation was loaded
+// from. It is empty for PodMutations loaded from files.
+type podMutationSource string
+
+// Sources of PodMutations.
+const (
+	sourcePodMutation        podMutationSource = kindPodMutation
+	sourceClusterPodMutation podMutationSource = kindClusterPodMutation
+)
+
 // A PodMutationSpec specifies the fields of a pod that will be updated.
 // +k8s:deepcopy-gen=true
 type PodMutationSpec struct {
+	// Priority determines the order in which PodMutations are applied when
+	// more than one is loaded. PodMutations are applied in ascending order of
+	// priority, and then by name.
+	Priority int32 `json:"priority,omitempty"`
+
+	// Mode determines whether the PodMutation mutates pods (Enforce), or only
+	// logs how it would have mutated them (Audit). Defaults to Enforce.
+	Mode PodMutationMode `json:"mode,omitempty"`
+
+	// Operations determines whether the PodMutation applies when pods are
+	// created (CREATE), updated (UPDATE), or both. Defaults to CREATE. Only
+	// the labels, annotations, and container images of existing pods are
+	// mutated on UPDATE, as are any ephemeral containers being added.
+	Operations []admissionregistration.OperationType `json:"operations,omitempty"`
+
+	// Selector determines which pods are mutated. All pods are mutated if the
+	// selector is omitted.
+	Selector *PodMutationSelector `json:"selector,omitempty"`
+
 	Strategy PodMutationStrategy `json:"strategy,omitempty"`
 	Template PodMutationTemplate `json:"template,omitempty"`
+
+	// ContainerTemplate is merged into each of the pod's existing containers,
+	// after the template has been merged into the pod.
+	ContainerTemplate *ContainerTemplate `json:"containerTemplate,omitempty"`
+
+	// InitContainerTemplate is merged into each of the pod's existing init
+	// containers, after the template has been merged into the pod.
+	InitContainerTemplate *ContainerTemplate `json:"initContainerTemplate,omitempty"`
+
+	// EphemeralContainerTemplate is merged into each ephemeral container
+	// added to a running pod via the ephemeralcontainers subresource, after
+	// the template has been merged into the pod. It applies only if the
+	// PodMutation's operations include UPDATE.
+	EphemeralContainerTemplate *ContainerTemplate `json:"ephemeralContainerTemplate,omitempty"`
+
+	// Patch is a list of RFC 6902 JSON patch operations applied to the pod
+	// after the templates have been merged into it. None of the operations
+	// are applied if any test operation fails.
+	Patch []JSONPatchOperation `json:"patch,omitempty"`
 }
 
 // A PodMutationTemplate specifies the fields of a pod that will be updated.
@@ -91,54 +234,401 @@ type PodMutationSpec struct {
 type PodMutationTemplate struct {
 	meta.ObjectMeta `json:"metadata,omitempty"`
 	Spec            core.PodSpec `json:"spec,omitempty"`
+
+	// raw is the template as it was decoded, including any strategic merge
+	// patch directives, or nil if the template was not decoded.
+	raw []byte
+}
+
+// UnmarshalJSON decodes a PodMutationTemplate, retaining the encoded template
+// so that any strategic merge patch directives it contains are preserved.
+func (t *PodMutationTemplate) UnmarshalJSON(b []byte) error {
+	type template PodMutationTemplate
+	tt := template{}
+	if err := json.Unmarshal(b, &tt); err != nil {
+		return err
+	}
+	*t = PodMutationTemplate(tt)
+	t.raw = append([]byte(nil), b...)
+	return nil
 }
 
+// MarshalJSON encodes a PodMutationTemplate. Decoded templates are encoded as
+// they were decoded, including any strategic merge patch directives.
+func (t PodMutationTemplate) MarshalJSON() ([]byte, error) {
+	if t.raw != nil {
+		return t.raw, nil
+	}
+	type template PodMutationTemplate
+	return json.Marshal(template(t))
+}
+
+// A PodMutationMode determines whether a PodMutation's patch is returned to
+// the API server.
+type PodMutationMode string
+
+// Supported PodMutationModes.
+const (
+	// EnforceMode mutates selected pods.
+	EnforceMode PodMutationMode = "Enforce"
+
+	// AuditMode computes and logs how selected pods would be mutated, but
+	// does not mutate them.
+	AuditMode PodMutationMode = "Audit"
+)
+
+// A PodMutationStrategyType determines how a PodMutationTemplate is applied.
+type PodMutationStrategyType string
+
+// Supported PodMutationStrategyTypes.
+const (
+	// MergeStrategy merges the template into the pod using Mergo, subject to
+	// the strategy's Overwrite and Append settings.
+	MergeStrategy PodMutationStrategyType = "Merge"
+
+	// StrategicMergeStrategy applies the template to the pod as a Kubernetes
+	// strategic merge patch.
+	StrategicMergeStrategy PodMutationStrategyType = "StrategicMerge"
+)
+
 // A PodMutationStrategy determines how pod configuration will be injected.
 // +k8s:deepcopy-gen=true
 type PodMutationStrategy struct {
-	// Overwrite keys that are already set in the original pod.
+	// Type of strategy used to apply the template. Defaults to Merge.
+	Type PodMutationStrategyType `json:"type,omitempty"`
+
+	// Overwrite keys that are already set in the original pod. Overwrite and
+	// Append do not affect how the template is applied by the StrategicMerge
+	// strategy, but do affect the container templates.
 	Overwrite bool `json:"overwrite,omitempty"`
 
-	// Append to, rather than replacing, arrays in the original pod.
+	// Append to, rather than replacing, arrays in the original pod. Arrays of
+	// containers, init containers, volumes, environment variables, volume
+	// mounts, ports, and tolerations are always merged by key; elements of
+	// the template are merged into the element of the original pod with the
+	// same key, or appended if there is no such element.
 	Append bool `json:"append,omitempty"`
 }
 
 // DecodePodMutation decodes a PodMutation from the provided bytes. It uses
 // k8s.io/apimachinery's UniversalDecoder in order to decode bytes encoded in
-// any format supported by Kubernetes (i.e. YAML, JSON, etc).
-func DecodePodMutation(data []byte) (PodMutation, error) {
+// any format supported by Kubernetes (i.e. YAML, JSON, etc). Unknown and
+// duplicate fields are handled per the configured UnknownFieldPolicy.
+func DecodePodMutation(data []byte, do ...DecodeOption) (PodMutation, error) {
+	pm, errs, err := decodePodMutation(data, do...)
+	if err != nil {
+		return PodMutation{}, err
+	}
+	if len(errs) > 0 {
+		return PodMutation{}, errors.Wrapf(errs.ToAggregate(), "invalid PodMutation %s", pm.GetName())
+	}
+	if err := parseTemplates(pm.Spec); err != nil {
+		return PodMutation{}, errors.Wrapf(err, "invalid PodMutation %s", pm.GetName())
+	}
+	return pm, nil
+}
+
+// decodePodMutation decodes the supplied YAML or JSON encoded PodMutation. It
+// returns the unknown and duplicate fields that the supplied DecodeOptions do
+// not permit alongside the decoded PodMutation.
+func decodePodMutation(data []byte, do ...DecodeOption) (PodMutation, field.ErrorList, error) {
+	o := &decodeOptions{l: zap.NewNop(), policy: FailOnUnknownFields}
+	for _, fn := range do {
+		fn(o)
+	}
+
 	scheme := runtime.NewScheme()
 	if err := AddToScheme(scheme); err != nil {
-		return PodMutation{}, errors.Wrap(err, "cannot register configuration scheme")
+		return PodMutation{}, nil, errors.Wrap(err, "cannot register configuration scheme")
 	}
 	codecs := runtimeserializer.NewCodecFactory(scheme)
 
 	var pm PodMutation
 	if _, _, err := codecs.UniversalDecoder().Decode(data, nil, &pm); err != nil {
-		return PodMutation{}, errors.Wrap(err, "cannot decode PodMutation")
+		return PodMutation{}, nil, errors.Wrap(err, "cannot decode PodMutation")
 	}
-	return pm, nil
+
+	errs, err := strictFields(data, pm.Spec.Strategy.Type == StrategicMergeStrategy)
+	if err != nil {
+		return PodMutation{}, nil, err
+	}
+	if o.policy != WarnOnUnknownFields {
+		return pm, errs, nil
+	}
+	for _, e := range errs {
+		o.l.Warn("ignoring unknown or duplicate field", zap.String("podMutation", pm.GetName()), zap.Error(e))
+	}
+	return pm, nil, nil
+}
+
+// Patch generates an RFC 6902 JSON patch for the supplied pod. The patch is
+// empty if the pod is not selected by the PodMutation.
+func (m PodMutation) Patch(r PodReview) ([]byte, error) {
+	return PodMutations{m}.Patch(r)
+}
+
+// mutate the supplied pod in place.
+func (m PodMutation) mutate(pod *core.Pod) error {
+	mo := mergeOptions(m.Spec.Strategy)
+	switch m.Spec.Strategy.Type {
+	case "", MergeStrategy:
+		if err := mergo.Merge(&pod.ObjectMeta, m.Spec.Template.ObjectMeta, mo...); err != nil {
+			return errors.Wrap(err, "cannot inject pod metadata")
+		}
+		if err := mergo.Merge(&pod.Spec, m.Spec.Template.Spec, mo...); err != nil {
+			return errors.Wrap(err, "cannot inject pod spec")
+		}
+	case StrategicMergeStrategy:
+		if err := strategicMerge(pod, m.Spec.Template); err != nil {
+			return errors.Wrap(err, "cannot inject template")
+		}
+	default:
+		return errors.Errorf("unknown strategy type %q", m.Spec.Strategy.Type)
+	}
+	if err := m.Spec.ContainerTemplate.mutate(pod.Spec.Containers, mo); err != nil {
+		return errors.Wrap(err, "cannot inject container template")
+	}
+	if err := m.Spec.InitContainerTemplate.mutate(pod.Spec.InitContainers, mo); err != nil {
+		return errors.Wrap(err, "cannot inject init container template")
+	}
+	if err := m.Spec.EphemeralContainerTemplate.mutateEphemeral(pod.Spec.EphemeralContainers, mo); err != nil {
+		return errors.Wrap(err, "cannot inject ephemeral container template")
+	}
+	if err := applyJSONPatch(pod, m.Spec.Patch); err != nil {
+		return errors.Wrap(err, "cannot apply JSON patch")
+	}
+	return nil
+}
+
+// PodMutations is a Patcher that applies several PodMutations to a pod in
+// order, producing a single patch.
+type PodMutations []PodMutation
+
+// Patch generates an RFC 6902 JSON patch for the supplied pod. The patch
+// describes the result of applying each PodMutation that selects the pod, in
+// order. PodMutations in audit mode are not applied.
+func (ms PodMutations) Patch(r PodReview) ([]byte, error) {
+	return ms.patch(r, false)
+}
+
+// Audit generates an RFC 6902 JSON patch for the supplied pod. The patch
+// describes the result of applying each PodMutation that selects the pod, in
+// order, including PodMutations in audit mode. The patch is nil if none of the
+// PodMutations are in audit mode.
+func (ms PodMutations) Audit(r PodReview) ([]byte, error) {
+	for _, m := range ms {
+		if m.Spec.Mode == AuditMode {
+			return ms.patch(r, true)
+		}
+	}
+	return nil, nil
+}
+
+func (ms PodMutations) patch(r PodReview, audit bool) ([]byte, error) {
+	injected := r.Pod.DeepCopy()
+	d := TemplateData{Pod: r.Pod, Namespace: r.Namespace, UserInfo: r.UserInfo}
+
+	// Ephemeral containers are never recorded as mutated, because they are
+	// added to pods that have already been marked.
+	var applied appliedPodMutations
+	if r.Marker != "" && r.SubResource != subResourceEphemeralContainers {
+		applied = parseApplied(r.Pod.GetAnnotations()[AppliedAnnotation(r.Marker)])
+	}
+	marked := false
+	ids := []string{}
+
+	for _, m := range ms {
+		if m.Spec.Mode == AuditMode && !audit {
+			continue
+		}
+		if !m.Spec.AppliesTo(r.Operation) {
+			continue
+		}
+		if m.source == sourcePodMutation && m.GetNamespace() != r.Namespace {
+			continue
+		}
+		ok, err := m.Spec.Selector.Selects(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot evaluate selector of PodMutation %s", m.GetName())
+		}
+		if !ok {
+			continue
+		}
+		hash, err := hashPodMutationSpec(m.Spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot hash PodMutation %s", m.GetName())
+		}
+		id := podMutationID(m)
+		if applied != nil {
+			if applied[id] == hash {
+				continue
+			}
+			applied[id] = hash
+			marked = true
+		}
+		ids = append(ids, id+"@"+hash)
+		if m.Spec, err = renderTemplates(m.Spec, d); err != nil {
+			return nil, errors.Wrapf(err, "cannot render templates of PodMutation %s", m.GetName())
+		}
+		if err := m.mutate(injected); err != nil {
+			return nil, errors.Wrapf(err, "cannot apply PodMutation %s", m.GetName())
+		}
+	}
+
+	if marked {
+		a := injected.GetAnnotations()
+		if a == nil {
+			a = map[string]string{}
+		}
+		a[r.Marker] = MutationDone
+		a[AppliedAnnotation(r.Marker)] = applied.String()
+		injected.SetAnnotations(a)
+	}
+
+	// Most fields of existing pods are immutable, so updates are limited to
+	// the fields that may be changed.
+	switch {
+	case r.SubResource == subResourceEphemeralContainers:
+		injected = withAddedEphemeralContainers(r.Pod, *injected, r.OldPod)
+	case r.Operation == admission.Update:
+		injected = withMutableFields(r.Pod, *injected)
+	}
+
+	if r.Provenance == "" || r.SubResource == subResourceEphemeralContainers || len(ids) == 0 {
+		return createPatch(r.Pod, *injected)
+	}
+	patch, pv, err := withProvenance(r, *injected, ids)
+	if err != nil || pv == nil {
+		return patch, err
+	}
+	if r.recordProvenance != nil && !audit {
+		r.recordProvenance(*pv)
+	}
+	return patch, nil
+}
+
+// withProvenance returns a patch that mutates the reviewed pod into the
+// injected pod, and records the supplied PodMutations and the paths they
+// modified in the review's Provenance annotation. Changes to Legion's own
+// annotations are not recorded, and nothing is recorded if the PodMutations
+// did not otherwise modify the pod. The recorded provenance is returned, or
+// nil if nothing was recorded.
+func withProvenance(r PodReview, injected core.Pod, ids []string) ([]byte, *Provenance, error) {
+	patch, err := createPatch(r.Pod, injected)
+	if err != nil {
+		return nil, nil, err
+	}
+	ignore := []string{r.Provenance}
+	if r.Marker != "" {
+		ignore = append(ignore, r.Marker, AppliedAnnotation(r.Marker))
+	}
+	paths, err := summarizePaths(patch, ignore...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return patch, nil, nil
+	}
+	pv := &Provenance{PodMutations: ids, Paths: paths}
+	b, err := json.Marshal(pv)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot encode provenance as JSON")
+	}
+	a := injected.GetAnnotations()
+	if a == nil {
+		a = map[string]string{}
+	}
+	a[r.Provenance] = string(b)
+	injected.SetAnnotations(a)
+	patch, err = createPatch(r.Pod, injected)
+	return patch, pv, err
 }
 
-// Patch generates an RFC 6902 JSON patch for the supplied pod.
-func (m PodMutation) Patch(original core.Pod) ([]byte, error) {
-	var injected core.Pod
-	original.DeepCopyInto(&injected)
+// AppliesTo returns true if the PodMutationSpec applies to the supplied
+// admission operation. An empty operation is treated as CREATE.
+func (s PodMutationSpec) AppliesTo(op admission.Operation) bool {
+	if op == "" {
+		op = admission.Create
+	}
+	if len(s.Operations) == 0 {
+		return op == admission.Create
+	}
+	for _, o := range s.Operations {
+		if string(o) == string(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// withMutableFields returns a copy of the original pod updated with the
+// labels, annotations, and container images of the injected pod. Container
+// images are matched by container name.
+func withMutableFields(original, injected core.Pod) *core.Pod {
+	out := original.DeepCopy()
+	out.SetLabels(injected.GetLabels())
+	out.SetAnnotations(injected.GetAnnotations())
+	withImages(out.Spec.Containers, injected.Spec.Containers)
+	withImages(out.Spec.InitContainers, injected.Spec.InitContainers)
+	return out
+}
+
+func withImages(cs, injected []core.Container) {
+	images := map[string]string{}
+	for _, c := range injected {
+		images[c.Name] = c.Image
+	}
+	for i := range cs {
+		if img, ok := images[cs[i].Name]; ok {
+			cs[i].Image = img
+		}
+	}
+}
 
-	mo := []func(*mergo.Config){}
-	if m.Spec.Strategy.Overwrite {
-		mo = append(mo, mergo.WithOverride)
+// withAddedEphemeralContainers returns a copy of the original pod in which the
+// ephemeral containers that are not present in the old pod are replaced with
+// their injected equivalents, matched by name. Ephemeral containers cannot be
+// changed once they have been added.
+func withAddedEphemeralContainers(original, injected core.Pod, old *core.Pod) *core.Pod {
+	existing := map[string]bool{}
+	if old != nil {
+		for _, ec := range old.Spec.EphemeralContainers {
+			existing[ec.Name] = true
+		}
 	}
-	if m.Spec.Strategy.Append {
-		mo = append(mo, mergo.WithAppendSlice)
+	added := map[string]core.EphemeralContainer{}
+	for _, ec := range injected.Spec.EphemeralContainers {
+		added[ec.Name] = ec
+	}
+	out := original.DeepCopy()
+	for i, ec := range out.Spec.EphemeralContainers {
+		if existing[ec.Name] {
+			continue
+		}
+		if iec, ok := added[ec.Name]; ok {
+			out.Spec.EphemeralContainers[i] = iec
+		}
 	}
-	if err := mergo.Merge(&injected.ObjectMeta, m.Spec.Template.ObjectMeta, mo...); err != nil {
-		return nil, errors.Wrap(err, "cannot inject pod metadata")
+	return out
+}
+
+// ByPriority sorts PodMutations in the order they should be applied; in
+// ascending order of priority, then by name, and then by namespace.
+type ByPriority []PodMutation
+
+func (ms ByPriority) Len() int      { return len(ms) }
+func (ms ByPriority) Swap(i, j int) { ms[i], ms[j] = ms[j], ms[i] }
+func (ms ByPriority) Less(i, j int) bool {
+	if ms[i].Spec.Priority != ms[j].Spec.Priority {
+		return ms[i].Spec.Priority < ms[j].Spec.Priority
 	}
-	if err := mergo.Merge(&injected.Spec, m.Spec.Template.Spec, mo...); err != nil {
-		return nil, errors.Wrap(err, "cannot inject pod spec")
+	if ms[i].GetName() != ms[j].GetName() {
+		return ms[i].GetName() < ms[j].GetName()
 	}
+	return ms[i].GetNamespace() < ms[j].GetNamespace()
+}
 
+func createPatch(original, injected core.Pod) ([]byte, error) {
 	ob := &bytes.Buffer{}
 	if err := serializer.Encode(&original, ob); err != nil {
 		return nil, errors.Wrap(err, "cannot encode original pod as JSON")
@@ -164,6 +654,20 @@ type PodMutator struct {
 	l      *zap.Logger
 	p      Patcher
 	ignore []IgnoreFunc
+	mode   PodMutationMode
+	marker string
+
+	provenance string
+	log        *MutationLog
+
+	workloads bool
+
+	// unmeasured PodMutators are used by PodValidators, which record their
+	// own measurements.
+	unmeasured bool
+
+	namespaces      NamespaceLabeler
+	namespacePolicy admissionregistration.FailurePolicyType
 }
 
 // IgnoreFunc returns true if a pod should be allowed without injection.
@@ -210,41 +714,138 @@ func WithIgnoreFuncs(fn ...IgnoreFunc) PodMutatorOption {
 	}
 }
 
+// WithMode configures a PodMutator to mutate pods (Enforce), or to only log
+// how it would have mutated them (Audit), regardless of the modes of the
+// PodMutations it applies.
+func WithMode(md PodMutationMode) PodMutatorOption {
+	return func(m *PodMutator) {
+		m.mode = md
+	}
+}
+
+// WithWorkloads configures a PodMutator to mutate the pod templates of
+// workloads, such as Deployments, in addition to pods. The patches it returns
+// for workloads apply to their pod templates. Pod templates are reviewed each
+// time a workload is updated, and the pods created from them are reviewed too,
+// so the PodMutator marks what it mutates using DefaultMarkerAnnotation unless
+// configured WithMarker. Otherwise PodMutations that append to lists would be
+// applied again by each review.
+func WithWorkloads() PodMutatorOption {
+	return func(m *PodMutator) {
+		m.workloads = true
+	}
+}
+
+// WithNamespaceLabeler configures a PodMutator to determine the labels of
+// each pod's namespace using the supplied NamespaceLabeler, for example a
+// NamespaceCache. The supplied policy determines whether pods are rejected
+// (Fail) or mutated as if their namespace matched no namespace selectors
+// (Ignore) when their namespace's labels are unknown, for example because the
+// cache has not yet synced.
+func WithNamespaceLabeler(l NamespaceLabeler, p admissionregistration.FailurePolicyType) PodMutatorOption {
+	return func(m *PodMutator) {
+		m.namespaces = l
+		m.namespacePolicy = p
+	}
+}
+
+// WithMarker configures a PodMutator to mark the pods it mutates with the
+// supplied annotation, and to record the PodMutations it applied to them such
+// that they are not applied again if a pod is reviewed more than once. Pods
+// marked as disabled are not mutated.
+func WithMarker(annotation string) PodMutatorOption {
+	return func(m *PodMutator) {
+		m.marker = annotation
+	}
+}
+
+// WithProvenance configures a PodMutator to record the PodMutations it applies
+// to each pod, and the paths they modify, in the supplied annotation. If the
+// supplied MutationLog is not nil the same information is recorded there.
+func WithProvenance(annotation string, l *MutationLog) PodMutatorOption {
+	return func(m *PodMutator) {
+		m.provenance = annotation
+		m.log = l
+	}
+}
+
 // NewPodMutator returns a new NewPodMutator with the supplied options.
 func NewPodMutator(p Patcher, mo ...PodMutatorOption) *PodMutator {
 	m := &PodMutator{l: zap.NewNop(), p: p}
 	for _, o := range mo {
 		o(m)
 	}
+	if m.workloads && m.marker == "" {
+		m.marker = DefaultMarkerAnnotation
+	}
 	return m
 }
 
-// Review approves and patches pod admission requests.
+// Review approves and patches pod admission requests, and workload admission
+// requests if configured to mutate workloads.
 func (m *PodMutator) Review(ar *admission.AdmissionRequest) *admission.AdmissionResponse {
+	dryRun := ar.DryRun != nil && *ar.DryRun
 	log := m.l.With(
 		zap.String("kind", ar.Kind.String()),
 		zap.String("namespace", ar.Namespace),
-		zap.String("name", ar.Name))
+		zap.String("name", ar.Name),
+		zap.Bool("dryRun", dryRun))
 
 	tags, _ := tag.New(context.Background(), // nolint:gosec
 		tag.Upsert(TagKind, ar.Kind.String()),
 		tag.Upsert(TagNamespace, ar.Namespace),
-		tag.Upsert(TagName, ar.Name))
+		tag.Upsert(TagName, ar.Name),
+		tag.Upsert(TagDryRun, strconv.FormatBool(dryRun)))
 
-	if ar.Resource != resourcePod {
+	// The pod templates of workloads are mutated as if they were pods. The
+	// resulting patch is prefixed with the path to the pod template.
+	gk := schema.GroupKind{Group: ar.Kind.Group, Kind: ar.Kind.Kind}
+	prefix, workload := PodTemplatePath(gk)
+	workload = workload && m.workloads && ar.Resource != resourcePod
+
+	if ar.Resource != resourcePod && !workload {
 		e := "cannot review non-pod resource"
 		log.Info(e, zap.String("expected", resourcePod.String()), zap.String("observed", ar.Resource.String()))
 		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
-		stats.Record(tags, MeasurePodsReviewed.M(1))
+		m.recordReview(tags)
 		return admissionError(errors.New(e), meta.StatusReasonInvalid)
 	}
 
-	var pod core.Pod
-	if _, _, err := serializer.Decode(ar.Object.Raw, nil, &pod); err != nil {
-		e := "cannot decode object as a pod"
+	// Webhooks registered for pods/* are sent updates to subresources such as
+	// status, which must never be denied.
+	if ar.SubResource != "" && ar.SubResource != subResourceEphemeralContainers {
+		log.Debug("not mutating pod subresource", zap.String("subresource", ar.SubResource))
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultIgnored)) // nolint:gosec
+		m.recordReview(tags)
+		return &admission.AdmissionResponse{Allowed: true}
+	}
+
+	switch ar.Operation {
+	case "", admission.Create, admission.Update:
+	default:
+		log.Debug("not mutating pod", zap.String("operation", string(ar.Operation)))
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultIgnored)) // nolint:gosec
+		m.recordReview(tags)
+		return &admission.AdmissionResponse{Allowed: true}
+	}
+
+	var (
+		pod core.Pod
+		old *core.Pod
+		err error
+	)
+	e := "cannot decode object as a pod"
+	switch {
+	case workload:
+		e = "cannot decode pod template"
+		pod, err = PodFromWorkload(gk, ar.Object.Raw)
+	default:
+		pod, old, err = decodePods(ar)
+	}
+	if err != nil {
 		log.Info(e, zap.Error(err))
 		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
-		stats.Record(tags, MeasurePodsReviewed.M(1))
+		m.recordReview(tags)
 		return admissionError(errors.Wrap(err, e), meta.StatusReasonInvalid)
 	}
 
@@ -252,23 +853,103 @@ func (m *PodMutator) Review(ar *admission.AdmissionRequest) *admission.Admission
 		if ignore(pod) {
 			log.Debug("not mutating ignored pod")
 			tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultIgnored)) // nolint:gosec
-			stats.Record(tags, MeasurePodsReviewed.M(1))
+			m.recordReview(tags)
 			return &admission.AdmissionResponse{Allowed: true}
 		}
 	}
 
-	patch, err := m.p.Patch(pod)
+	if m.marker != "" && pod.GetAnnotations()[m.marker] == MutationDisabled {
+		log.Debug("not mutating pod with mutation disabled", zap.String("annotation", m.marker))
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultIgnored)) // nolint:gosec
+		m.recordReview(tags)
+		return &admission.AdmissionResponse{Allowed: true}
+	}
+
+	pr := PodReview{
+		Pod:         pod,
+		Namespace:   ar.Namespace,
+		UserInfo:    ar.UserInfo,
+		Operation:   ar.Operation,
+		SubResource: ar.SubResource,
+		OldPod:      old,
+		Marker:      m.marker,
+		Provenance:  m.provenance,
+	}
+	if workload {
+		// Pod templates describe pods that are yet to be created.
+		pr.Operation, pr.SubResource, pr.OldPod = admission.Create, "", nil
+	}
+	if m.namespaces != nil {
+		pr.namespaceLabels = m.namespaceLabels(ar.Namespace, log)
+	}
+	var pv *Provenance
+	if m.log != nil && m.mode != AuditMode {
+		pr.recordProvenance = func(p Provenance) { pv = &p }
+	}
+
+	patch, err := m.p.Patch(pr)
+	if ue, ok := errors.Cause(err).(errUnknownNamespace); ok {
+		e := "cannot determine namespace labels"
+		log.Info(e, zap.Error(ue.error))
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
+		m.recordReview(tags)
+		return admissionError(errors.Wrap(ue.error, e), meta.StatusReasonServiceUnavailable)
+	}
 	if err != nil {
 		e := "cannot patch pod"
 		log.Info(e, zap.Error(err))
 		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
-		stats.Record(tags, MeasurePodsReviewed.M(1))
+		m.recordReview(tags)
 		return admissionError(errors.Wrap(err, e), meta.StatusReasonInternalError)
 	}
 
+	// Pods that PodMutations in audit mode would have mutated, or any pod
+	// when the PodMutator itself is in audit mode, are allowed without the
+	// audited mutations.
+	audit := m.audit(pr, log)
+	audited := m.mode == AuditMode || (audit != nil && m.differs(patch, audit, log))
+	if audit == nil {
+		audit = patch
+	}
+	if pv != nil {
+		m.record(ar, *pv)
+	}
+	// Patches are computed for pods. They are relocated to the pod templates
+	// of workloads, and to the fields of EphemeralContainers objects.
+	var rebase func([]byte) ([]byte, error)
+	switch {
+	case workload:
+		rebase = func(p []byte) ([]byte, error) { return prefixPatch(p, prefix) }
+	case ar.Kind.Kind == kindEphemeralContainers:
+		rebase = func(p []byte) ([]byte, error) {
+			return relocatePatch(p, "/spec/ephemeralContainers", "/ephemeralContainers")
+		}
+	}
+	if rebase != nil {
+		if patch, err = rebase(patch); err == nil {
+			audit, err = rebase(audit)
+		}
+		if err != nil {
+			e := "cannot patch pod template"
+			log.Info(e, zap.Error(err))
+			tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
+			m.recordReview(tags)
+			return admissionError(errors.Wrap(err, e), meta.StatusReasonInternalError)
+		}
+	}
+	if audited {
+		log.Info("audited pod", zap.ByteString("original", ar.Object.Raw), zap.ByteString("patch", audit))
+		m.recordAudit(tags)
+	}
+	if m.mode == AuditMode {
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultAudited)) // nolint:gosec
+		m.recordReview(tags)
+		return &admission.AdmissionResponse{UID: ar.UID, Allowed: true}
+	}
+
 	log.Debug("mutated pod", zap.ByteString("original", ar.Object.Raw), zap.ByteString("patch", patch))
 	tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultMutated)) // nolint:gosec
-	stats.Record(tags, MeasurePodsReviewed.M(1))
+	m.recordReview(tags)
 	return &admission.AdmissionResponse{
 		UID:       ar.UID,
 		Allowed:   true,
@@ -277,6 +958,170 @@ func (m *PodMutator) Review(ar *admission.AdmissionRequest) *admission.Admission
 	}
 }
 
+// namespaceLabels returns a function that determines the labels of the supplied
+// namespace the first time it is called. Namespace labels are only determined
+// if a PodMutation that would otherwise select a pod has a namespace
+// selector. If the labels cannot be determined the function returns an
+// errUnknownNamespace, or nil labels if the PodMutator's namespace policy is
+// Ignore.
+func (m *PodMutator) namespaceLabels(namespace string, log *zap.Logger) func() (labels.Set, error) {
+	var (
+		once sync.Once
+		ls   labels.Set
+		err  error
+	)
+	return func() (labels.Set, error) {
+		once.Do(func() {
+			ls, err = m.namespaces.Labels(namespace)
+			if err == nil {
+				return
+			}
+			if m.namespacePolicy == admissionregistration.Fail {
+				err = errUnknownNamespace{err}
+				return
+			}
+			log.Debug("cannot determine namespace labels; ignoring namespace selectors", zap.Error(err))
+			ls, err = nil, nil
+		})
+		return ls, err
+	}
+}
+
+// recordReview records that a pod was reviewed.
+func (m *PodMutator) recordReview(ctx context.Context) {
+	if m.unmeasured {
+		return
+	}
+	stats.Record(ctx, MeasurePodsReviewed.M(1))
+}
+
+// recordAudit records that PodMutations in audit mode would have mutated a
+// pod.
+func (m *PodMutator) recordAudit(ctx context.Context) {
+	if m.unmeasured {
+		return
+	}
+	stats.Record(ctx, MeasurePodsAudited.M(1))
+}
+
+// record the supplied provenance of the reviewed pod in the PodMutator's
+// MutationLog.
+func (m *PodMutator) record(ar *admission.AdmissionRequest, pv Provenance) {
+	m.log.Record(MutationRecord{
+		Time:       meta.Now(),
+		UID:        string(ar.UID),
+		Kind:       ar.Kind.Kind,
+		Namespace:  ar.Namespace,
+		Name:       ar.Name,
+		DryRun:     ar.DryRun != nil && *ar.DryRun,
+		Provenance: pv,
+	})
+}
+
+// decodePods decodes the pod under review, and the pod prior to an update.
+func decodePods(ar *admission.AdmissionRequest) (core.Pod, *core.Pod, error) {
+	pod, err := decodePod(ar.Kind, ar.Object.Raw)
+	if err != nil {
+		return core.Pod{}, nil, err
+	}
+	if len(ar.OldObject.Raw) == 0 {
+		return pod, nil, nil
+	}
+	old, err := decodePod(ar.Kind, ar.OldObject.Raw)
+	if err != nil {
+		return core.Pod{}, nil, errors.Wrap(err, "cannot decode old object")
+	}
+	return pod, &old, nil
+}
+
+// decodePod decodes the supplied pod. Kubernetes versions prior to 1.22 send an
+// EphemeralContainers object when ephemeral containers are added to a pod,
+// which is decoded as a pod with only metadata and ephemeral containers.
+func decodePod(kind meta.GroupVersionKind, raw []byte) (core.Pod, error) {
+	if kind.Kind == kindEphemeralContainers {
+		ec := core.EphemeralContainers{}
+		if _, _, err := serializer.Decode(raw, nil, &ec); err != nil {
+			return core.Pod{}, err
+		}
+		return core.Pod{
+			TypeMeta:   meta.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: ec.ObjectMeta,
+			Spec:       core.PodSpec{EphemeralContainers: ec.EphemeralContainers},
+		}, nil
+	}
+	pod := core.Pod{}
+	_, _, err := serializer.Decode(raw, nil, &pod)
+	return pod, err
+}
+
+// audit returns the patch that would be returned for the supplied pod if
+// PodMutations in audit mode were enforced. It returns nil if there are no
+// PodMutations in audit mode, or if the PodMutator's Patcher is not an Auditor.
+func (m *PodMutator) audit(pr PodReview, log *zap.Logger) []byte {
+	a, ok := m.p.(Auditor)
+	if !ok {
+		return nil
+	}
+	audit, err := a.Audit(pr)
+	if err != nil {
+		// Failing to audit a pod must not prevent it from being mutated.
+		log.Info("cannot audit pod", zap.Error(err))
+		return nil
+	}
+	return audit
+}
+
+// differs returns true if the supplied audit patch mutates a pod differently
+// from the supplied patch. Changes to the PodMutator's marker and provenance
+// annotations are ignored; they differ whenever a PodMutation in audit mode
+// selects the pod, even if it would not change it.
+func (m *PodMutator) differs(patch, audit []byte, log *zap.Logger) bool {
+	ignore := []string{}
+	if m.marker != "" {
+		ignore = append(ignore, m.marker, AppliedAnnotation(m.marker))
+	}
+	if m.provenance != "" {
+		ignore = append(ignore, m.provenance)
+	}
+	p, err := withoutAnnotations(patch, ignore...)
+	if err != nil {
+		log.Info("cannot audit pod", zap.Error(err))
+		return false
+	}
+	a, err := withoutAnnotations(audit, ignore...)
+	if err != nil {
+		log.Info("cannot audit pod", zap.Error(err))
+		return false
+	}
+	return !reflect.DeepEqual(p, a)
+}
+
+// withoutAnnotations returns the operations of the supplied RFC 6902 JSON
+// patch, omitting changes to the supplied annotations.
+func withoutAnnotations(patch []byte, annotations ...string) ([]jsonpatch.Operation, error) {
+	ops := []jsonpatch.Operation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(err, "cannot decode patch")
+	}
+	omit := map[string]bool{}
+	for _, a := range annotations {
+		omit["/metadata/annotations/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(a)] = true
+	}
+	out := make([]jsonpatch.Operation, 0, len(ops))
+	for _, op := range ops {
+		if omit[op.Path] {
+			continue
+		}
+		if v, ok := op.Value.(map[string]interface{}); ok && op.Path == "/metadata/annotations" {
+			for _, a := range annotations {
+				delete(v, a)
+			}
+		}
+		out = append(out, op)
+	}
+	return out, nil
+}
+
 func admissionError(err error, reason meta.StatusReason) *admission.AdmissionResponse {
 	return &admission.AdmissionResponse{
 		Result: &meta.Status{
@@ -18,14 +18,18 @@ package kubernetes
 
 import (
 	"bytes"
+	"sort"
 	"testing"
 
 	"github.com/go-test/deep"
 	"github.com/pkg/errors"
-	admission "k8s.io/api/admission/v1beta1"
+	"go.uber.org/zap"
+	admission "k8s.io/api/admission/v1"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 const (
@@ -83,6 +87,48 @@ spec:
     }
   }
 }
+`
+
+	selectivePodMutationYAML = `
+---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: selective
+spec:
+  selector:
+    matchLabels:
+      cool: 'true'
+    excludeHostNetwork: true
+  template:
+    metadata:
+      annotations:
+        cool.planet.com/selected: 'true'
+`
+
+	selectivePodMutationJSON = `
+{
+  "apiVersion": "legion.planet.com/v1alpha1",
+  "kind": "PodMutation",
+  "metadata": {
+    "name": "selective"
+  },
+  "spec": {
+    "selector": {
+      "matchLabels": {
+        "cool": "true"
+      },
+      "excludeHostNetwork": true
+    },
+    "template": {
+      "metadata": {
+        "annotations": {
+          "cool.planet.com/selected": "true"
+        }
+      }
+    }
+  }
+}
 `
 )
 
@@ -118,6 +164,20 @@ var (
 			},
 		},
 	}
+
+	selectivePodMutation = PodMutation{
+		TypeMeta:   meta.TypeMeta{APIVersion: SchemeGroupVersion.String(), Kind: "PodMutation"},
+		ObjectMeta: meta.ObjectMeta{Name: "selective"},
+		Spec: PodMutationSpec{
+			Selector: &PodMutationSelector{
+				LabelSelector:      meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}},
+				ExcludeHostNetwork: true,
+			},
+			Template: PodMutationTemplate{
+				ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"cool.planet.com/selected": "true"}},
+			},
+		},
+	}
 )
 
 func TestPatch(t *testing.T) {
@@ -183,7 +243,164 @@ func TestPatch(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			got, _ := tc.spec.Patch(tc.pod)
+			got, _ := tc.spec.Patch(PodReview{Pod: tc.pod})
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want:\nbytes:\n  %v\nstringified:\n  got:  %s\n  want: %s\n", diff, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPodMutationsPatch(t *testing.T) {
+	cases := []struct {
+		name string
+		pod  core.Pod
+		pms  PodMutations
+		want []byte
+	}{
+		{
+			name: "NoOp",
+			pod:  coolPod,
+			pms:  PodMutations{},
+			want: []byte("[]"),
+		},
+		{
+			name: "CombinedPatch",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "annotate"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "alsotrue"}},
+						},
+					},
+				},
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "label"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Labels: map[string]string{"supercool": "alsotrue"}},
+						},
+					},
+				},
+			},
+			want: []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/supercool\",\"value\":\"alsotrue\"},{\"op\":\"add\",\"path\":\"/metadata/labels/supercool\",\"value\":\"alsotrue\"}]"),
+		},
+		{
+			name: "LaterMutationsOverwrite",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "first"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "first"}},
+						},
+					},
+				},
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "second"},
+					Spec: PodMutationSpec{
+						Strategy: PodMutationStrategy{Overwrite: true},
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "second"}},
+						},
+					},
+				},
+			},
+			want: []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/supercool\",\"value\":\"second\"}]"),
+		},
+		{
+			name: "UnselectedMutationsSkipped",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "selected"},
+					Spec: PodMutationSpec{
+						Selector: &PodMutationSelector{
+							LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}},
+						},
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"selected": "true"}},
+						},
+					},
+				},
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "unselected"},
+					Spec: PodMutationSpec{
+						Selector: &PodMutationSelector{Namespaces: []string{"uncoolnamespace"}},
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"unselected": "true"}},
+						},
+					},
+				},
+			},
+			want: []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/selected\",\"value\":\"true\"}]"),
+		},
+		{
+			name: "NamespacedMutationsApplyToTheirNamespace",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "same", Namespace: "coolnamespace"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"same": "true"}},
+						},
+					},
+					source: sourcePodMutation,
+				},
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "other", Namespace: "uncoolnamespace"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"other": "true"}},
+						},
+					},
+					source: sourcePodMutation,
+				},
+			},
+			want: []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/same\",\"value\":\"true\"}]"),
+		},
+		{
+			// Only namespaced custom resources are limited to their
+			// namespace.
+			name: "FileMutationsApplyToAnyNamespace",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "file", Namespace: "uncoolnamespace"},
+					Spec: PodMutationSpec{
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"file": "true"}},
+						},
+					},
+				},
+			},
+			want: []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/file\",\"value\":\"true\"}]"),
+		},
+		{
+			name: "AuditedMutationsSkipped",
+			pod:  coolPod,
+			pms: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "audited"},
+					Spec: PodMutationSpec{
+						Mode: AuditMode,
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"audited": "true"}},
+						},
+					},
+				},
+			},
+			want: []byte("[]"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := tc.pms.Patch(PodReview{Pod: tc.pod, Namespace: tc.pod.GetNamespace()})
 			if diff := deep.Equal(got, tc.want); diff != nil {
 				t.Errorf("got != want:\nbytes:\n  %v\nstringified:\n  got:  %s\n  want: %s\n", diff, got, tc.want)
 			}
@@ -191,16 +408,133 @@ func TestPatch(t *testing.T) {
 	}
 }
 
+func TestPodMutationsAudit(t *testing.T) {
+	pms := PodMutations{
+		{
+			ObjectMeta: meta.ObjectMeta{Name: "audited"},
+			Spec: PodMutationSpec{
+				Mode: AuditMode,
+				Template: PodMutationTemplate{
+					ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"audited": "true"}},
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Name: "enforced"},
+			Spec: PodMutationSpec{
+				Mode: EnforceMode,
+				Template: PodMutationTemplate{
+					ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"enforced": "true"}},
+				},
+			},
+		},
+	}
+	got, err := pms.Audit(PodReview{Pod: coolPod, Namespace: coolPod.GetNamespace()})
+	if err != nil {
+		t.Fatalf("pms.Audit(...): %v", err)
+	}
+	want := []byte("[{\"op\":\"add\",\"path\":\"/metadata/annotations/audited\",\"value\":\"true\"},{\"op\":\"add\",\"path\":\"/metadata/annotations/enforced\",\"value\":\"true\"}]")
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("got != want:\nbytes:\n  %v\nstringified:\n  got:  %s\n  want: %s\n", diff, got, want)
+	}
+
+	// There is nothing to audit without PodMutations in audit mode.
+	got, err = pms[1:].Audit(PodReview{Pod: coolPod, Namespace: coolPod.GetNamespace()})
+	if err != nil {
+		t.Fatalf("pms.Audit(...): %v", err)
+	}
+	if got != nil {
+		t.Errorf("pms.Audit(...): got %s, want nil", got)
+	}
+}
+
+func TestPodMutatorDiffers(t *testing.T) {
+	m := NewPodMutator(PodMutations{}, WithMarker("marker"), WithProvenance("provenance", nil))
+	cases := []struct {
+		name  string
+		patch string
+		audit string
+		want  bool
+	}{
+		{
+			name:  "Identical",
+			patch: `[{"op":"add","path":"/metadata/annotations/cool","value":"true"}]`,
+			audit: `[{"op":"add","path":"/metadata/annotations/cool","value":"true"}]`,
+		},
+		{
+			name:  "OnlyMarkersDiffer",
+			patch: `[{"op":"add","path":"/metadata/annotations/marker-applied","value":"a=1"},{"op":"add","path":"/metadata/annotations/provenance","value":"{}"}]`,
+			audit: `[{"op":"add","path":"/metadata/annotations/marker-applied","value":"a=1,b=2"},{"op":"add","path":"/metadata/annotations/provenance","value":"{\"b\":2}"}]`,
+		},
+		{
+			name:  "OnlyMarkersDifferWithoutAnnotations",
+			patch: `[{"op":"add","path":"/metadata/annotations","value":{"cool":"true","marker":"mutated","marker-applied":"a=1"}}]`,
+			audit: `[{"op":"add","path":"/metadata/annotations","value":{"cool":"true","marker":"mutated","marker-applied":"a=1,b=2"}}]`,
+		},
+		{
+			name:  "Different",
+			patch: `[{"op":"add","path":"/metadata/annotations/marker-applied","value":"a=1"}]`,
+			audit: `[{"op":"add","path":"/metadata/annotations/marker-applied","value":"a=1,b=2"},{"op":"add","path":"/metadata/annotations/audited","value":"true"}]`,
+			want:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := m.differs([]byte(tc.patch), []byte(tc.audit), zap.NewNop()); got != tc.want {
+				t.Errorf("m.differs(...): got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	pms := []PodMutation{
+		{ObjectMeta: meta.ObjectMeta{Name: "b"}, Spec: PodMutationSpec{Priority: 10}},
+		{ObjectMeta: meta.ObjectMeta{Name: "c"}},
+		{ObjectMeta: meta.ObjectMeta{Name: "a"}, Spec: PodMutationSpec{Priority: 10}},
+		{ObjectMeta: meta.ObjectMeta{Name: "d"}, Spec: PodMutationSpec{Priority: -1}},
+		{ObjectMeta: meta.ObjectMeta{Name: "c", Namespace: "coolnamespace"}},
+	}
+	sort.Sort(ByPriority(pms))
+
+	got := []string{}
+	for _, pm := range pms {
+		got = append(got, pm.GetNamespace()+"/"+pm.GetName())
+	}
+	want := []string{"/d", "/c", "coolnamespace/c", "/a", "/b"}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("got != want:\n%v\n", diff)
+	}
+}
+
 type predictablePatcher struct {
 	patch []byte
 	err   error
 }
 
-func (p *predictablePatcher) Patch(_ core.Pod) ([]byte, error) {
+func (p *predictablePatcher) Patch(_ PodReview) ([]byte, error) {
 	return p.patch, p.err
 }
 
+type recordingPatcher struct {
+	reviews []PodReview
+}
+
+func (p *recordingPatcher) Patch(pr PodReview) ([]byte, error) {
+	p.reviews = append(p.reviews, pr)
+	return coolPatch, nil
+}
+
 func TestReview(t *testing.T) {
+	namespaceSelectingPodMutation := PodMutation{
+		ObjectMeta: meta.ObjectMeta{Name: "namespaced"},
+		Spec: PodMutationSpec{
+			Selector: &PodMutationSelector{NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}}},
+			Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "true"}}},
+		},
+	}
+
 	cases := []struct {
 		name    string
 		patcher Patcher
@@ -273,6 +607,67 @@ func TestReview(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "NamespaceLabelsUnknownFail",
+			patcher: PodMutations{namespaceSelectingPodMutation},
+			options: []PodMutatorOption{WithNamespaceLabeler(NewNamespaceCache(fake.NewSimpleClientset()), admissionregistration.Fail)},
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Namespace: "coolnamespace",
+				Object: runtime.RawExtension{Raw: func() []byte {
+					b := &bytes.Buffer{}
+					serializer.Encode(&coolPod, b)
+					return b.Bytes()
+				}()},
+			},
+			want: &admission.AdmissionResponse{
+				Result: &meta.Status{
+					Status:  meta.StatusFailure,
+					Reason:  meta.StatusReasonServiceUnavailable,
+					Message: `cannot determine namespace labels: cannot get namespace coolnamespace: namespaces "coolnamespace" not found`,
+				},
+			},
+		},
+		{
+			name:    "NamespaceLabelsUnknownIgnore",
+			patcher: PodMutations{namespaceSelectingPodMutation},
+			options: []PodMutatorOption{WithNamespaceLabeler(NewNamespaceCache(fake.NewSimpleClientset()), admissionregistration.Ignore)},
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Namespace: "coolnamespace",
+				Object: runtime.RawExtension{Raw: func() []byte {
+					b := &bytes.Buffer{}
+					serializer.Encode(&coolPod, b)
+					return b.Bytes()
+				}()},
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte("[]"),
+				PatchType: &jsonPatch,
+			},
+		},
+		{
+			// Namespace labels are not needed unless a PodMutation selects
+			// pods by namespace.
+			name:    "NamespaceLabelsNotNeeded",
+			patcher: &predictablePatcher{patch: coolPatch},
+			options: []PodMutatorOption{WithNamespaceLabeler(NewNamespaceCache(fake.NewSimpleClientset()), admissionregistration.Fail)},
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Namespace: "coolnamespace",
+				Object: runtime.RawExtension{Raw: func() []byte {
+					b := &bytes.Buffer{}
+					serializer.Encode(&coolPod, b)
+					return b.Bytes()
+				}()},
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     coolPatch,
+				PatchType: &jsonPatch,
+			},
+		},
 		{
 			name:    "PatchSuccessful",
 			patcher: &predictablePatcher{patch: coolPatch},
@@ -290,6 +685,47 @@ func TestReview(t *testing.T) {
 				PatchType: &jsonPatch,
 			},
 		},
+		{
+			name:    "AuditMode",
+			patcher: &predictablePatcher{patch: coolPatch},
+			options: []PodMutatorOption{WithMode(AuditMode)},
+			ar: &admission.AdmissionRequest{
+				Resource: resourcePod,
+				Object: runtime.RawExtension{Raw: func() []byte {
+					b := &bytes.Buffer{}
+					serializer.Encode(&coolPod, b)
+					return b.Bytes()
+				}()},
+			},
+			want: &admission.AdmissionResponse{Allowed: true},
+		},
+		{
+			name: "PodMutationInAuditMode",
+			patcher: PodMutations{
+				{
+					ObjectMeta: meta.ObjectMeta{Name: "audited"},
+					Spec: PodMutationSpec{
+						Mode: AuditMode,
+						Template: PodMutationTemplate{
+							ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"audited": "true"}},
+						},
+					},
+				},
+			},
+			ar: &admission.AdmissionRequest{
+				Resource: resourcePod,
+				Object: runtime.RawExtension{Raw: func() []byte {
+					b := &bytes.Buffer{}
+					serializer.Encode(&coolPod, b)
+					return b.Bytes()
+				}()},
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte("[]"),
+				PatchType: &jsonPatch,
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -302,6 +738,145 @@ func TestReview(t *testing.T) {
 	}
 }
 
+func TestReviewOperations(t *testing.T) {
+	encode := func(obj runtime.Object) runtime.RawExtension {
+		b := &bytes.Buffer{}
+		serializer.Encode(obj, b)
+		return runtime.RawExtension{Raw: b.Bytes()}
+	}
+	update := []admissionregistration.OperationType{admissionregistration.Update}
+
+	debugged := coolPod.DeepCopy()
+	debugged.Spec.EphemeralContainers = []core.EphemeralContainer{{
+		EphemeralContainerCommon: core.EphemeralContainerCommon{Name: "debugger", Image: "busybox"},
+	}}
+
+	pms := PodMutations{
+		{
+			ObjectMeta: meta.ObjectMeta{Name: "create"},
+			Spec: PodMutationSpec{
+				Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"created": "true"}}},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Name: "update"},
+			Spec: PodMutationSpec{
+				Operations: update,
+				Strategy:   PodMutationStrategy{Overwrite: true},
+				Template: PodMutationTemplate{
+					ObjectMeta: meta.ObjectMeta{Labels: map[string]string{"updated": "true"}},
+					Spec:       core.PodSpec{Hostname: "immutable"},
+				},
+				ContainerTemplate: &ContainerTemplate{Template: core.Container{Image: "coolimage:cooler", Args: []string{"-immutable"}}},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Name: "debug"},
+			Spec: PodMutationSpec{
+				Operations:                 update,
+				EphemeralContainerTemplate: &ContainerTemplate{Template: core.Container{Env: []core.EnvVar{{Name: "DEBUG", Value: "true"}}}},
+			},
+		},
+	}
+
+	cases := []struct {
+		name string
+		ar   *admission.AdmissionRequest
+		want *admission.AdmissionResponse
+	}{
+		{
+			name: "Create",
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Operation: admission.Create,
+				Object:    encode(&coolPod),
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(`[{"op":"add","path":"/metadata/annotations/created","value":"true"}]`),
+				PatchType: &jsonPatch,
+			},
+		},
+		{
+			name: "UpdateOnlyMutableFields",
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Operation: admission.Update,
+				Object:    encode(&coolPod),
+				OldObject: encode(&coolPod),
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(`[{"op":"add","path":"/metadata/labels/updated","value":"true"},{"op":"replace","path":"/spec/containers/0/image","value":"coolimage:cooler"}]`),
+				PatchType: &jsonPatch,
+			},
+		},
+		{
+			name: "Delete",
+			ar: &admission.AdmissionRequest{
+				Resource:  resourcePod,
+				Operation: admission.Delete,
+				OldObject: encode(&coolPod),
+			},
+			want: &admission.AdmissionResponse{Allowed: true},
+		},
+		{
+			name: "UnsupportedSubResource",
+			ar: &admission.AdmissionRequest{
+				Resource:    resourcePod,
+				SubResource: "status",
+				Operation:   admission.Update,
+				Object:      encode(&coolPod),
+			},
+			want: &admission.AdmissionResponse{Allowed: true},
+		},
+		{
+			name: "EphemeralContainersPod",
+			ar: &admission.AdmissionRequest{
+				Kind:        meta.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Resource:    resourcePod,
+				SubResource: subResourceEphemeralContainers,
+				Operation:   admission.Update,
+				Object:      encode(debugged),
+				OldObject:   encode(&coolPod),
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(`[{"op":"add","path":"/spec/ephemeralContainers/0/env","value":[{"name":"DEBUG","value":"true"}]}]`),
+				PatchType: &jsonPatch,
+			},
+		},
+		{
+			name: "EphemeralContainers",
+			ar: &admission.AdmissionRequest{
+				Kind:        meta.GroupVersionKind{Version: "v1", Kind: kindEphemeralContainers},
+				Resource:    resourcePod,
+				SubResource: subResourceEphemeralContainers,
+				Operation:   admission.Update,
+				Object: encode(&core.EphemeralContainers{
+					ObjectMeta:          coolPod.ObjectMeta,
+					EphemeralContainers: debugged.Spec.EphemeralContainers,
+				}),
+				OldObject: encode(&core.EphemeralContainers{ObjectMeta: coolPod.ObjectMeta}),
+			},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(`[{"op":"add","path":"/ephemeralContainers/0/env","value":[{"name":"DEBUG","value":"true"}]}]`),
+				PatchType: &jsonPatch,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NewPodMutator(pms).Review(tc.ar)
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want:\n%v\nstringified patch: %s", diff, got.Patch)
+			}
+		})
+	}
+}
+
 func TestIgnoreFunc(t *testing.T) {
 	cases := []struct {
 		name string
@@ -365,6 +940,8 @@ func TestDecodePodMutation(t *testing.T) {
 	}{
 		{name: "YAML", data: []byte(coolPodMutationYAML), want: coolPodMutation},
 		{name: "JSON", data: []byte(coolPodMutationJSON), want: coolPodMutation},
+		{name: "SelectorYAML", data: []byte(selectivePodMutationYAML), want: selectivePodMutation},
+		{name: "SelectorJSON", data: []byte(selectivePodMutationJSON), want: selectivePodMutation},
 	}
 
 	for _, tc := range cases {
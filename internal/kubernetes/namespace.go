@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A NamespaceLabeler returns the labels of a namespace.
+type NamespaceLabeler interface {
+	Labels(namespace string) (labels.Set, error)
+}
+
+// StaticNamespaceLabels is a NamespaceLabeler that returns the labels of a
+// fixed set of namespaces.
+type StaticNamespaceLabels map[string]labels.Set
+
+// Labels returns the labels of the supplied namespace.
+func (s StaticNamespaceLabels) Labels(namespace string) (labels.Set, error) {
+	ls, ok := s[namespace]
+	if !ok {
+		return nil, errors.Errorf("unknown namespace %s", namespace)
+	}
+	if ls == nil {
+		return labels.Set{}, nil
+	}
+	return ls, nil
+}
+
+// namespaceGetTimeout is how long a NamespaceCache waits to get a namespace
+// that is not in the cache from the API server.
+const namespaceGetTimeout = 3 * time.Second
+
+// A NamespaceCache is an informer-backed cache of namespace metadata.
+type NamespaceCache struct {
+	client   clientset.Interface
+	informer cache.SharedIndexInformer
+	lister   corelisters.NamespaceLister
+}
+
+// NewNamespaceCache returns a NamespaceCache that watches namespaces using
+// the supplied client. The cache is empty until it is run.
+func NewNamespaceCache(c clientset.Interface) *NamespaceCache {
+	i := coreinformers.NewNamespaceInformer(c, 0, cache.Indexers{})
+	return &NamespaceCache{client: c, informer: i, lister: corelisters.NewNamespaceLister(i.GetIndexer())}
+}
+
+// Run the NamespaceCache until the supplied context is done.
+func (c *NamespaceCache) Run(ctx context.Context) error {
+	c.informer.Run(ctx.Done())
+	return nil
+}
+
+// Synced returns true if the NamespaceCache has synced with the API server.
+func (c *NamespaceCache) Synced() bool {
+	return c.informer.HasSynced()
+}
+
+// WaitForSync blocks until the NamespaceCache has synced with the API server.
+// It returns false if the supplied context is done before the cache syncs.
+func (c *NamespaceCache) WaitForSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), c.Synced)
+}
+
+// Labels returns the labels of the supplied namespace. Namespaces that are not
+// in the cache, for example because it has not yet synced or because they
+// were created very recently, are read from the API server. The returned
+// labels are never nil.
+func (c *NamespaceCache) Labels(namespace string) (labels.Set, error) {
+	ns, err := c.lister.Get(namespace)
+	if err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), namespaceGetTimeout)
+		defer cancel()
+		ns, err = c.client.CoreV1().Namespaces().Get(ctx, namespace, meta.GetOptions{})
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get namespace %s", namespace)
+	}
+	ls := labels.Set{}
+	for k, v := range ns.GetLabels() {
+		ls[k] = v
+	}
+	return ls, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceCache(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&core.Namespace{ObjectMeta: meta.ObjectMeta{Name: "coolnamespace", Labels: map[string]string{"cool": "true"}}},
+		&core.Namespace{ObjectMeta: meta.ObjectMeta{Name: "unlabelled"}},
+	)
+	c := NewNamespaceCache(client)
+
+	// Namespaces are read from the API server until the cache syncs.
+	if got, err := c.Labels("coolnamespace"); err != nil || got["cool"] != "true" {
+		t.Errorf("c.Labels(...): got %v, %v from unsynced cache, want cool=true", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx) // nolint:errcheck
+	if !c.WaitForSync(ctx) {
+		t.Fatalf("c.WaitForSync(...): cache did not sync")
+	}
+
+	cases := []struct {
+		name      string
+		namespace string
+		want      labels.Set
+		wantErr   bool
+	}{
+		{name: "Labelled", namespace: "coolnamespace", want: labels.Set{"cool": "true"}},
+		{name: "Unlabelled", namespace: "unlabelled", want: labels.Set{}},
+		{name: "Missing", namespace: "missing", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := c.Labels(tc.namespace)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("c.Labels(%q): want error, got nil", tc.namespace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.Labels(%q): %v", tc.namespace, err)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want:\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestStaticNamespaceLabels(t *testing.T) {
+	s := StaticNamespaceLabels{"coolnamespace": labels.Set{"cool": "true"}, "unlabelled": nil}
+
+	cases := []struct {
+		name      string
+		namespace string
+		want      labels.Set
+		wantErr   bool
+	}{
+		{name: "Labelled", namespace: "coolnamespace", want: labels.Set{"cool": "true"}},
+		{name: "Unlabelled", namespace: "unlabelled", want: labels.Set{}},
+		{name: "Missing", namespace: "missing", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.Labels(tc.namespace)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("s.Labels(%q): want error, got nil", tc.namespace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("s.Labels(%q): %v", tc.namespace, err)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want:\n%v\n", diff)
+			}
+		})
+	}
+}
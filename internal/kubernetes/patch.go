@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/appscode/jsonpatch"
+	rfc6902 "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// A JSONPatchOperation is an RFC 6902 JSON patch operation.
+// +k8s:deepcopy-gen=true
+type JSONPatchOperation struct {
+	// Op is one of add, remove, replace, move, copy, or test.
+	Op string `json:"op"`
+
+	// Path is a JSON pointer to the target of the operation.
+	Path string `json:"path"`
+
+	// From is a JSON pointer to the source of a move or copy operation.
+	From string `json:"from,omitempty"`
+
+	// Value to add, replace, or test.
+	Value *runtime.RawExtension `json:"value,omitempty"`
+}
+
+// applyJSONPatch applies the supplied operations to the supplied pod in place.
+// The operations are applied atomically; the pod is left untouched if a test
+// operation fails.
+func applyJSONPatch(pod *core.Pod, ops []JSONPatchOperation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ob, err := json.Marshal(ops)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode patch operations as JSON")
+	}
+	p, err := rfc6902.DecodePatch(ob)
+	if err != nil {
+		return errors.Wrap(err, "cannot decode patch operations")
+	}
+
+	pb, err := json.Marshal(pod)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode pod as JSON")
+	}
+	patched, err := p.Apply(pb)
+	if errors.Cause(err) == rfc6902.ErrTestFailed {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot apply patch operations")
+	}
+
+	out := core.Pod{}
+	if err := json.Unmarshal(patched, &out); err != nil {
+		return errors.Wrap(err, "cannot decode patched pod")
+	}
+	*pod = out
+	return nil
+}
+
+// relocatePatch replaces the supplied prefix of the path of each operation of
+// the supplied RFC 6902 JSON patch. Every operation must target a path under
+// the prefix.
+func relocatePatch(patch []byte, from, to string) ([]byte, error) {
+	ops := []jsonpatch.Operation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(err, "cannot decode patch")
+	}
+	for i := range ops {
+		if ops[i].Path != from && !strings.HasPrefix(ops[i].Path, from+"/") {
+			return nil, errors.Errorf("cannot apply %s of %s to %s", ops[i].Operation, ops[i].Path, to)
+		}
+		ops[i].Path = to + strings.TrimPrefix(ops[i].Path, from)
+	}
+	b, err := json.Marshal(ops)
+	return b, errors.Wrap(err, "cannot encode patch as JSON")
+}
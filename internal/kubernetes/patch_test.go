@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestJSONPatch(t *testing.T) {
+	value := func(s string) *runtime.RawExtension { return &runtime.RawExtension{Raw: []byte(s)} }
+
+	cases := []struct {
+		name      string
+		spec      PodMutationSpec
+		want      []byte
+		wantError bool
+	}{
+		{
+			name: "RemoveAnnotation",
+			spec: PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "remove", Path: "/metadata/annotations/cool"},
+			}},
+			// The pod has only one annotation, so removing it removes them all.
+			want: []byte(`[{"op":"remove","path":"/metadata/annotations"}]`),
+		},
+		{
+			name: "ReplaceArrayElement",
+			spec: PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "replace", Path: "/spec/containers/0/args/0", Value: value(`"-extremely"`)},
+			}},
+			want: []byte(`[{"op":"replace","path":"/spec/containers/0/args/0","value":"-extremely"}]`),
+		},
+		{
+			name: "AppliedAfterTemplate",
+			spec: PodMutationSpec{
+				Strategy: PodMutationStrategy{Overwrite: true},
+				Template: PodMutationTemplate{Spec: core.PodSpec{DNSPolicy: core.DNSDefault}},
+				Patch: []JSONPatchOperation{
+					{Op: "test", Path: "/spec/dnsPolicy", Value: value(`"Default"`)},
+					{Op: "copy", From: "/spec/dnsPolicy", Path: "/metadata/labels/dns"},
+				},
+			},
+			want: []byte(`[{"op":"add","path":"/metadata/labels/dns","value":"Default"},{"op":"replace","path":"/spec/dnsPolicy","value":"Default"}]`),
+		},
+		{
+			name: "TestFailed",
+			spec: PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "add", Path: "/metadata/labels/injected", Value: value(`"true"`)},
+				{Op: "test", Path: "/metadata/labels/cool", Value: value(`"false"`)},
+			}},
+			want: []byte(`[]`),
+		},
+		{
+			name: "MissingPath",
+			spec: PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "remove", Path: "/spec/nodeSelector/cool"},
+			}},
+			wantError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := PodMutation{Spec: tc.spec}.Patch(PodReview{Pod: coolPod})
+			if err != nil {
+				if !tc.wantError {
+					t.Fatalf("m.Patch(...): %v", err)
+				}
+				return
+			}
+			if tc.wantError {
+				t.Fatalf("m.Patch(...): want error, got nil")
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("m.Patch(...): got != want:\n  got:  %s\n  want: %s\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONPatch(t *testing.T) {
+	data := []byte(`---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: patch
+spec:
+  patch:
+  - op: add
+    path: /metadata/labels/cool
+    value: "true"
+  - op: remove
+    path: /spec/hostNetwork
+`)
+	want := []JSONPatchOperation{
+		{Op: "add", Path: "/metadata/labels/cool", Value: &runtime.RawExtension{Raw: []byte(`"true"`)}},
+		{Op: "remove", Path: "/spec/hostNetwork"},
+	}
+
+	m, err := DecodePodMutation(data)
+	if err != nil {
+		t.Fatalf("DecodePodMutation(...): %v", err)
+	}
+	if diff := deep.Equal(m.Spec.Patch, want); diff != nil {
+		t.Errorf("DecodePodMutation(...): got != want: %v", diff)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultProvenanceAnnotation is the default annotation in which Legion
+// records how it mutated a pod.
+const DefaultProvenanceAnnotation = "legion.planet.com/provenance"
+
+// provenanceDepth is the number of path segments to which patch paths are
+// truncated when summarised.
+const provenanceDepth = 3
+
+// Provenance describes how Legion mutated a pod.
+type Provenance struct {
+	// PodMutations that were applied to the pod, in order. Each is identified
+	// by its name, prefixed with its kind and namespace if it is a custom
+	// resource, and suffixed with its version; a hash of its spec. For example
+	// PodMutation/team/sidecar@1a2b3c4d5e6f7a8b.
+	PodMutations []string `json:"podMutations"`
+
+	// Paths modified by the patch, truncated to at most three segments.
+	Paths []string `json:"paths"`
+}
+
+// summarizePaths returns the sorted, distinct paths of the operations of the
+// supplied RFC 6902 JSON patch, truncated to at most three segments. Changes to
+// the supplied annotations are omitted.
+func summarizePaths(patch []byte, ignore ...string) ([]string, error) {
+	ops, err := withoutAnnotations(patch, ignore...)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, op := range ops {
+		if v, ok := op.Value.(map[string]interface{}); ok && op.Path == "/metadata/annotations" && len(v) == 0 {
+			continue
+		}
+		s := strings.SplitN(strings.TrimPrefix(op.Path, "/"), "/", provenanceDepth+1)
+		if len(s) > provenanceDepth {
+			s = s[:provenanceDepth]
+		}
+		p := "/" + strings.Join(s, "/")
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// A MutationRecord describes a mutated pod.
+type MutationRecord struct {
+	Time      meta.Time `json:"time"`
+	UID       string    `json:"uid"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name,omitempty"`
+	DryRun    bool      `json:"dryRun,omitempty"`
+	Provenance
+}
+
+// A MutationLog records the provenance of the most recently mutated pods.
+type MutationLog struct {
+	size int
+
+	mx      sync.Mutex
+	records []MutationRecord
+}
+
+// DefaultMutationLogSize is the default number of records kept by a
+// MutationLog.
+const DefaultMutationLogSize = 100
+
+// NewMutationLog returns a MutationLog that keeps the supplied number of
+// records.
+func NewMutationLog(size int) *MutationLog {
+	return &MutationLog{size: size}
+}
+
+// Record the supplied MutationRecord, discarding the oldest record if the
+// MutationLog is full.
+func (l *MutationLog) Record(r MutationRecord) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.records = append(l.records, r)
+	if len(l.records) > l.size {
+		l.records = l.records[len(l.records)-l.size:]
+	}
+}
+
+// Records returns the recorded MutationRecords, most recent first.
+func (l *MutationLog) Records() []MutationRecord {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	out := make([]MutationRecord, len(l.records))
+	for i, r := range l.records {
+		out[len(out)-1-i] = r
+	}
+	return out
+}
+
+// ServeHTTP serves the recorded MutationRecords as JSON, most recent first.
+func (l *MutationLog) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.Records()); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot encode mutation records").Error(), http.StatusInternalServerError)
+	}
+}
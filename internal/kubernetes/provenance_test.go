@@ -0,0 +1,201 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	rfc6902 "github.com/evanphx/json-patch"
+	"github.com/go-test/deep"
+	admission "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestSummarizePaths(t *testing.T) {
+	patch := `[
+		{"op":"add","path":"/metadata/annotations/cool","value":"true"},
+		{"op":"add","path":"/spec/containers/0/env/0","value":{"name":"COOL"}},
+		{"op":"add","path":"/spec/containers/0/env/1","value":{"name":"COOLER"}},
+		{"op":"replace","path":"/spec/dnsPolicy","value":"Default"}
+	]`
+	want := []string{"/metadata/annotations/cool", "/spec/containers/0", "/spec/dnsPolicy"}
+
+	got, err := summarizePaths([]byte(patch))
+	if err != nil {
+		t.Fatalf("summarizePaths(...): %v", err)
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("summarizePaths(...): got != want: %v", diff)
+	}
+}
+
+func TestSummarizePathsIgnoresAnnotations(t *testing.T) {
+	cases := []struct {
+		name  string
+		patch string
+		want  []string
+	}{
+		{
+			name: "AnnotationsAdded",
+			patch: `[
+				{"op":"add","path":"/metadata/annotations/example.org~1marker","value":"done"},
+				{"op":"add","path":"/metadata/annotations/cool","value":"true"}
+			]`,
+			want: []string{"/metadata/annotations/cool"},
+		},
+		{
+			name:  "AnnotationsCreated",
+			patch: `[{"op":"add","path":"/metadata/annotations","value":{"example.org/marker":"done"}}]`,
+			want:  []string{},
+		},
+		{
+			name:  "AnnotationsCreatedWithOthers",
+			patch: `[{"op":"add","path":"/metadata/annotations","value":{"example.org/marker":"done","cool":"true"}}]`,
+			want:  []string{"/metadata/annotations"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := summarizePaths([]byte(tc.patch), "example.org/marker")
+			if err != nil {
+				t.Fatalf("summarizePaths(...): %v", err)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("summarizePaths(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestMutationLog(t *testing.T) {
+	l := NewMutationLog(2)
+	for _, name := range []string{"a", "b", "c"} {
+		l.Record(MutationRecord{Name: name})
+	}
+
+	got := []string{}
+	for _, r := range l.Records() {
+		got = append(got, r.Name)
+	}
+	if diff := deep.Equal(got, []string{"c", "b"}); diff != nil {
+		t.Errorf("l.Records(): got != want: %v", diff)
+	}
+}
+
+func TestReviewProvenance(t *testing.T) {
+	pm := PodMutation{
+		ObjectMeta: meta.ObjectMeta{Name: "annotate", Namespace: "coolnamespace"},
+		Spec: PodMutationSpec{
+			Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"supercool": "true"}}},
+		},
+		source: sourcePodMutation,
+	}
+	hash, err := hashPodMutationSpec(pm.Spec)
+	if err != nil {
+		t.Fatalf("hashPodMutationSpec(...): %v", err)
+	}
+	want := Provenance{
+		PodMutations: []string{"PodMutation/coolnamespace/annotate@" + hash},
+		Paths:        []string{"/metadata/annotations/supercool"},
+	}
+
+	encode := func(p *core.Pod) runtime.RawExtension {
+		b := &bytes.Buffer{}
+		serializer.Encode(p, b)
+		return runtime.RawExtension{Raw: b.Bytes()}
+	}
+
+	l := NewMutationLog(DefaultMutationLogSize)
+	m := NewPodMutator(PodMutations{pm}, WithMarker("marker"), WithProvenance("provenance", l))
+	rsp := m.Review(&admission.AdmissionRequest{
+		UID:       "cool",
+		Kind:      meta.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  resourcePod,
+		Namespace: "coolnamespace",
+		Name:      "coolpod",
+		Object:    encode(&coolPod),
+	})
+
+	patched := applyPatch(t, coolPod, rsp.Patch)
+	got := Provenance{}
+	if err := json.Unmarshal([]byte(patched.GetAnnotations()["provenance"]), &got); err != nil {
+		t.Fatalf("patch %s does not record provenance: %v", rsp.Patch, err)
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("m.Review(...): got != want: %v", diff)
+	}
+
+	// Reviewing an already mutated pod does not record provenance again.
+	v, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v): %v", want, err)
+	}
+	mutated := coolPod.DeepCopy()
+	mutated.Annotations = map[string]string{
+		"cool":                      "true",
+		"supercool":                 "true",
+		"marker":                    MutationDone,
+		AppliedAnnotation("marker"): patched.GetAnnotations()[AppliedAnnotation("marker")],
+		"provenance":                string(v),
+	}
+	m.Review(&admission.AdmissionRequest{UID: "cooler", Resource: resourcePod, Namespace: "coolnamespace", Object: encode(mutated)})
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/last-mutations", nil))
+	records := []MutationRecord{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+		t.Fatalf("cannot decode %s: %v", rec.Body.Bytes(), err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("l.ServeHTTP(...): got %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.UID != "cool" || r.Namespace != "coolnamespace" || r.Name != "coolpod" || r.Kind != "Pod" {
+		t.Errorf("l.ServeHTTP(...): got record for %s %s %s/%s", r.UID, r.Kind, r.Namespace, r.Name)
+	}
+	if diff := deep.Equal(r.Provenance, want); diff != nil {
+		t.Errorf("l.ServeHTTP(...): got != want: %v", diff)
+	}
+}
+
+// applyPatch returns the supplied pod with the supplied RFC 6902 JSON patch
+// applied.
+func applyPatch(t *testing.T, pod core.Pod, patch []byte) core.Pod {
+	t.Helper()
+	p, err := rfc6902.DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("rfc6902.DecodePatch(%s): %v", patch, err)
+	}
+	b, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("json.Marshal(...): %v", err)
+	}
+	if b, err = p.Apply(b); err != nil {
+		t.Fatalf("p.Apply(...): %v", err)
+	}
+	out := core.Pod{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	return out
+}
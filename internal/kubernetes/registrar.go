@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// A CABundleFunc returns the PEM encoded certificates with which the API
+// server should verify Legion's serving certificate.
+type CABundleFunc func() ([]byte, error)
+
+// A WebhookRegistrar registers Legion's MutatingWebhookConfiguration with the
+// API server.
+type WebhookRegistrar struct {
+	client   clientset.Interface
+	name     string
+	svc      admissionregistration.ServiceReference
+	caBundle CABundleFunc
+	wo       []WebhookOption
+	l        *zap.Logger
+
+	workloads bool
+}
+
+// A WebhookRegistrarOption configures a WebhookRegistrar.
+type WebhookRegistrarOption func(r *WebhookRegistrar)
+
+// WithRegistrarLogger configures a WebhookRegistrar to use the supplied
+// logger.
+func WithRegistrarLogger(l *zap.Logger) WebhookRegistrarOption {
+	return func(r *WebhookRegistrar) {
+		r.l = l
+	}
+}
+
+// WithWebhookOptions configures the webhook registered by a WebhookRegistrar.
+func WithWebhookOptions(wo ...WebhookOption) WebhookRegistrarOption {
+	return func(r *WebhookRegistrar) {
+		r.wo = append(r.wo, wo...)
+	}
+}
+
+// WithWorkloadWebhook configures a WebhookRegistrar to also register a webhook
+// that sends workloads, such as Deployments, to Legion.
+func WithWorkloadWebhook() WebhookRegistrarOption {
+	return func(r *WebhookRegistrar) {
+		r.workloads = true
+	}
+}
+
+// NewWebhookRegistrar returns a WebhookRegistrar that registers the named
+// MutatingWebhookConfiguration, which sends pods to the supplied service.
+func NewWebhookRegistrar(c clientset.Interface, name string, svc admissionregistration.ServiceReference, caBundle CABundleFunc, o ...WebhookRegistrarOption) *WebhookRegistrar {
+	r := &WebhookRegistrar{client: c, name: name, svc: svc, caBundle: caBundle, l: zap.NewNop()}
+	for _, fn := range o {
+		fn(r)
+	}
+	return r
+}
+
+// Register creates or updates the MutatingWebhookConfiguration such that its
+// rules, selectors, and CA bundle reflect the supplied PodMutations and the
+// current CA bundle.
+func (r *WebhookRegistrar) Register(ctx context.Context, pms PodMutations) error {
+	bundle, err := r.caBundle()
+	if err != nil {
+		return errors.Wrap(err, "cannot load CA bundle")
+	}
+	want := NewMutatingWebhookConfiguration(r.name, r.svc, bundle, pms, r.wo...)
+	if r.workloads {
+		want.Webhooks = append(want.Webhooks, NewWorkloadMutatingWebhook(WorkloadWebhookName(r.name), r.svc, bundle, pms, r.wo...))
+	}
+
+	configs := r.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		got, err := configs.Get(ctx, r.name, meta.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			_, err = configs.Create(ctx, want, meta.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		got.Webhooks = want.Webhooks
+		_, err = configs.Update(ctx, got, meta.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot register MutatingWebhookConfiguration %s", r.name)
+	}
+	r.l.Info("registered webhook", zap.String("name", r.name), zap.Int("mutations", len(pms)))
+	return nil
+}
+
+// Deregister deletes the MutatingWebhookConfiguration, if it exists. The
+// MutatingWebhookConfiguration is deleted even if other replicas of Legion
+// still serve it.
+func (r *WebhookRegistrar) Deregister(ctx context.Context) error {
+	err := r.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(ctx, r.name, meta.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "cannot deregister MutatingWebhookConfiguration %s", r.name)
+	}
+	r.l.Info("deregistered webhook", zap.String("name", r.name))
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWebhookRegistrar(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	bundle := []byte("cool")
+	svc := admissionregistration.ServiceReference{Namespace: "legion", Name: "legion"}
+	r := NewWebhookRegistrar(client, "legion.planet.com", svc, func() ([]byte, error) { return bundle, nil },
+		WithWebhookOptions(WithFailurePolicy(admissionregistration.Ignore)))
+
+	selecting := func(v string) PodMutations {
+		return PodMutations{{Spec: PodMutationSpec{Selector: &PodMutationSelector{
+			LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": v}},
+		}}}}
+	}
+	registered := func() *admissionregistration.MutatingWebhook {
+		t.Helper()
+		c, err := configs.Get(ctx, "legion.planet.com", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get MutatingWebhookConfiguration: %v", err)
+		}
+		if len(c.Webhooks) != 1 {
+			t.Fatalf("c.Webhooks: got %d webhooks, want 1", len(c.Webhooks))
+		}
+		return &c.Webhooks[0]
+	}
+
+	// The first registration creates the MutatingWebhookConfiguration.
+	if err := r.Register(ctx, selecting("true")); err != nil {
+		t.Fatalf("r.Register(...): %v", err)
+	}
+	w := registered()
+	if diff := deep.Equal(w.ObjectSelector.MatchExpressions[0].Values, []string{"true"}); diff != nil {
+		t.Errorf("w.ObjectSelector: got != want: %v", diff)
+	}
+	if got, want := *w.FailurePolicy, admissionregistration.Ignore; got != want {
+		t.Errorf("w.FailurePolicy: got %q, want %q", got, want)
+	}
+
+	// Subsequent registrations update it.
+	bundle = []byte("cooler")
+	if err := r.Register(ctx, selecting("yes")); err != nil {
+		t.Fatalf("r.Register(...): %v", err)
+	}
+	w = registered()
+	if diff := deep.Equal(w.ObjectSelector.MatchExpressions[0].Values, []string{"yes"}); diff != nil {
+		t.Errorf("w.ObjectSelector: got != want: %v", diff)
+	}
+	if got, want := string(w.ClientConfig.CABundle), "cooler"; got != want {
+		t.Errorf("w.ClientConfig.CABundle: got %q, want %q", got, want)
+	}
+
+	// Deregistration deletes it, and tolerates it having been deleted.
+	for i := 0; i < 2; i++ {
+		if err := r.Deregister(ctx); err != nil {
+			t.Fatalf("r.Deregister(): %v", err)
+		}
+	}
+	if _, err := configs.Get(ctx, "legion.planet.com", meta.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("Get MutatingWebhookConfiguration: want not found, got %v", err)
+	}
+}
+
+func TestWebhookRegistrarCABundleError(t *testing.T) {
+	r := NewWebhookRegistrar(fake.NewSimpleClientset(), "legion.planet.com", admissionregistration.ServiceReference{},
+		func() ([]byte, error) { return nil, errors.New("boom") })
+	if err := r.Register(context.Background(), nil); err == nil {
+		t.Errorf("r.Register(...): want error, got nil")
+	}
+}
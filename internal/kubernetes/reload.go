@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+)
+
+// Opencensus measurements.
+var (
+	MeasureConfigGeneration = stats.Int64("config/generation", "Generation of the loaded configuration.", stats.UnitDimensionless)
+	MeasureConfigReloads    = stats.Int64("config/reloads", "Number of configuration reloads.", stats.UnitDimensionless)
+)
+
+// A Reloader is a Patcher that loads PodMutations from disk, and reloads them
+// whenever they change.
+type Reloader struct {
+	path string
+	l    *zap.Logger
+	do   []DecodeOption
+	fn   []func(PodMutations)
+
+	mx         sync.Mutex
+	generation int64
+	current    atomic.Value // Always a loadedConfig.
+}
+
+type loadedConfig struct {
+	pms        PodMutations
+	hash       string
+	generation int64
+}
+
+// A ReloaderOption configures a Reloader.
+type ReloaderOption func(r *Reloader)
+
+// WithReloaderLogger configures a Reloader to use the supplied logger.
+func WithReloaderLogger(l *zap.Logger) ReloaderOption {
+	return func(r *Reloader) {
+		r.l = l
+	}
+}
+
+// WithDecodeOptions configures a Reloader to decode PodMutations using the
+// supplied DecodeOptions.
+func WithDecodeOptions(do ...DecodeOption) ReloaderOption {
+	return func(r *Reloader) {
+		r.do = do
+	}
+}
+
+// WithReloadFuncs configures a Reloader to call the supplied functions with
+// the reloaded PodMutations whenever they change. The functions are not called
+// for the PodMutations loaded by NewReloader.
+func WithReloadFuncs(fn ...func(PodMutations)) ReloaderOption {
+	return func(r *Reloader) {
+		r.fn = append(r.fn, fn...)
+	}
+}
+
+// NewReloader returns a Reloader that has loaded the PodMutations at the
+// supplied path, which may be either a file or a directory.
+func NewReloader(path string, ro ...ReloaderOption) (*Reloader, error) {
+	r := &Reloader{path: path, l: zap.NewNop()}
+	for _, o := range ro {
+		o(r)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Patch generates an RFC 6902 JSON patch for the supplied pod using the most
+// recently loaded PodMutations.
+func (r *Reloader) Patch(pr PodReview) ([]byte, error) {
+	return r.PodMutations().Patch(pr)
+}
+
+// Audit generates an RFC 6902 JSON patch for the supplied pod using the most
+// recently loaded PodMutations, including those in audit mode.
+func (r *Reloader) Audit(pr PodReview) ([]byte, error) {
+	return r.PodMutations().Audit(pr)
+}
+
+// PodMutations returns the most recently loaded PodMutations.
+func (r *Reloader) PodMutations() PodMutations {
+	return r.current.Load().(loadedConfig).pms
+}
+
+// Reload the PodMutations from disk. The previously loaded PodMutations remain
+// in use if the new PodMutations cannot be loaded.
+func (r *Reloader) Reload() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	pms, err := LoadPodMutations(r.path, r.do...)
+	if err != nil {
+		recordReload(tagResultError)
+		return err
+	}
+	hash, err := hashPodMutations(pms)
+	if err != nil {
+		recordReload(tagResultError)
+		return err
+	}
+
+	previous, reloaded := r.current.Load().(loadedConfig)
+	if reloaded && previous.hash == hash {
+		return nil
+	}
+
+	r.generation++
+	c := loadedConfig{pms: pms, hash: hash, generation: r.generation}
+	r.current.Store(c)
+	r.l.Info("loaded configuration",
+		zap.String("path", r.path),
+		zap.Int("mutations", len(pms)),
+		zap.String("hash", hash),
+		zap.Int64("generation", c.generation))
+	recordReload(tagResultSuccess)
+	stats.Record(context.Background(), MeasureConfigGeneration.M(c.generation))
+
+	if reloaded {
+		for _, fn := range r.fn {
+			fn(pms)
+		}
+	}
+	return nil
+}
+
+func recordReload(result string) {
+	tags, _ := tag.New(context.Background(), tag.Upsert(TagResult, result)) // nolint:gosec
+	stats.Record(tags, MeasureConfigReloads.M(1))
+}
+
+// Run watches the configuration for changes, reloading it as necessary, until
+// the supplied context is done. The directory containing the configuration is
+// watched rather than the configuration itself in order to observe the atomic
+// symlink swaps Kubernetes uses to update ConfigMap volumes.
+func (r *Reloader) Run(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create configuration watcher")
+	}
+	defer w.Close()
+
+	dir := r.path
+	if fi, err := os.Stat(r.path); err == nil && !fi.IsDir() {
+		dir = filepath.Dir(r.path)
+	}
+	if err := w.Add(dir); err != nil {
+		return errors.Wrapf(err, "cannot watch %s", dir)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-w.Events:
+			r.l.Debug("configuration changed", zap.String("path", e.Name), zap.String("op", e.Op.String()))
+			if err := r.Reload(); err != nil {
+				r.l.Info("cannot reload configuration; continuing to serve previous configuration", zap.Error(err))
+			}
+		case err := <-w.Errors:
+			r.l.Info("error watching configuration", zap.Error(err))
+		}
+	}
+}
+
+// hashPodMutations hashes the identity and spec of the supplied PodMutations.
+// Other metadata, such as the resource versions and statuses of custom
+// resources, does not affect how pods are mutated and is not hashed.
+func hashPodMutations(pms PodMutations) (string, error) {
+	type hashed struct {
+		ID   string          `json:"id"`
+		Spec PodMutationSpec `json:"spec"`
+	}
+	h := make([]hashed, 0, len(pms))
+	for _, pm := range pms {
+		h = append(h, hashed{ID: podMutationID(pm), Spec: pm.Spec})
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode PodMutations as JSON")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16], nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cool", 0))
+
+	reloaded := [][]string{}
+	r, err := NewReloader(dir, WithReloadFuncs(func(pms PodMutations) { reloaded = append(reloaded, names(pms)) }))
+	if err != nil {
+		t.Fatalf("NewReloader(%q): %v", dir, err)
+	}
+	if got, want := r.current.Load().(loadedConfig).generation, int64(1); got != want {
+		t.Errorf("generation: got %d, want %d", got, want)
+	}
+
+	// Reloading unchanged configuration should not bump the generation.
+	if err := r.Reload(); err != nil {
+		t.Fatalf("r.Reload(): %v", err)
+	}
+	if got, want := r.current.Load().(loadedConfig).generation, int64(1); got != want {
+		t.Errorf("generation: got %d, want %d", got, want)
+	}
+
+	writeFile(t, filepath.Join(dir, "b.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cooler", 1))
+	if err := r.Reload(); err != nil {
+		t.Fatalf("r.Reload(): %v", err)
+	}
+	if got, want := r.current.Load().(loadedConfig).generation, int64(2); got != want {
+		t.Errorf("generation: got %d, want %d", got, want)
+	}
+	if diff := deep.Equal(names(r.PodMutations()), []string{"cool", "cooler"}); diff != nil {
+		t.Errorf("r.PodMutations(): got != want:\n%v\n", diff)
+	}
+
+	// Reload funcs should be called only when the configuration changes.
+	if diff := deep.Equal(reloaded, [][]string{{"cool", "cooler"}}); diff != nil {
+		t.Errorf("reload funcs: got != want:\n%v\n", diff)
+	}
+
+	// Invalid configuration should be rejected in favor of the last good
+	// configuration.
+	writeFile(t, filepath.Join(dir, "c.yaml"), "imnotapodmutation")
+	if err := r.Reload(); err == nil {
+		t.Errorf("r.Reload(): want error, got nil")
+	}
+	if diff := deep.Equal(names(r.PodMutations()), []string{"cool", "cooler"}); diff != nil {
+		t.Errorf("r.PodMutations(): got != want:\n%v\n", diff)
+	}
+}
+
+func TestReloadRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legion")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mimic the layout of a Kubernetes ConfigMap volume.
+	writeFile(t, filepath.Join(dir, "..2018_12_31", "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cool", 0))
+	if err := os.Symlink("..2018_12_31", filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("os.Symlink(...): %v", err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "a.yaml"), filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatalf("os.Symlink(...): %v", err)
+	}
+
+	r, err := NewReloader(filepath.Join(dir, "a.yaml"))
+	if err != nil {
+		t.Fatalf("NewReloader(...): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+
+	// Give the watcher a moment to start before swapping the ConfigMap data.
+	time.Sleep(100 * time.Millisecond)
+
+	writeFile(t, filepath.Join(dir, "..2019_01_01", "a.yaml"), fmt.Sprintf(podMutationYAMLFmt, "cooler", 0))
+	if err := os.Symlink("..2019_01_01", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatalf("os.Symlink(...): %v", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("os.Rename(...): %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for names(r.PodMutations())[0] != "cooler" {
+		if time.Now().After(deadline) {
+			t.Fatalf("r.PodMutations(): got %v, want [cooler]", names(r.PodMutations()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("r.Run(): %v", err)
+	}
+}
+
+func TestHashPodMutations(t *testing.T) {
+	pm := PodMutation{
+		ObjectMeta: meta.ObjectMeta{Namespace: "coolnamespace", Name: "cool", ResourceVersion: "1"},
+		Spec:       PodMutationSpec{Priority: 1},
+		source:     sourcePodMutation,
+	}
+	statusUpdated := pm
+	statusUpdated.ObjectMeta = meta.ObjectMeta{
+		Namespace:       "coolnamespace",
+		Name:            "cool",
+		ResourceVersion: "2",
+		ManagedFields:   []meta.ManagedFieldsEntry{{Manager: "legion", Operation: meta.ManagedFieldsOperationUpdate}},
+	}
+	respecified := pm
+	respecified.Spec = PodMutationSpec{Priority: 2}
+	moved := pm
+	moved.ObjectMeta = meta.ObjectMeta{Namespace: "uncoolnamespace", Name: "cool", ResourceVersion: "1"}
+
+	cases := []struct {
+		name    string
+		pm      PodMutation
+		changed bool
+	}{
+		{name: "MetadataChanged", pm: statusUpdated, changed: false},
+		{name: "SpecChanged", pm: respecified, changed: true},
+		{name: "NamespaceChanged", pm: moved, changed: true},
+	}
+
+	want, err := hashPodMutations(PodMutations{pm})
+	if err != nil {
+		t.Fatalf("hashPodMutations(...): %v", err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := hashPodMutations(PodMutations{tc.pm})
+			if err != nil {
+				t.Fatalf("hashPodMutations(...): %v", err)
+			}
+			if changed := got != want; changed != tc.changed {
+				t.Errorf("hashPodMutations(...): got hash %s, want changed %t from %s", got, tc.changed, want)
+			}
+		})
+	}
+}
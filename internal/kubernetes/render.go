@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	authentication "k8s.io/api/authentication/v1"
+	core "k8s.io/api/core/v1"
+)
+
+// templateDelim starts a Go template expression.
+const templateDelim = "{{"
+
+// TemplateData is the data with which the Go template expressions in a
+// PodMutationSpec are rendered.
+type TemplateData struct {
+	// Pod under review.
+	Pod core.Pod
+
+	// Namespace in which the pod is being created.
+	Namespace string
+
+	// UserInfo of the user that made the admission request.
+	UserInfo authentication.UserInfo
+}
+
+// A stringFunc transforms a string found at the supplied path.
+type stringFunc func(path, s string) (string, error)
+
+// parseTemplates returns an error if any of the Go template expressions in
+// the supplied PodMutationSpec cannot be parsed.
+func parseTemplates(s PodMutationSpec) error {
+	fn := func(path, s string) (string, error) {
+		if !strings.Contains(s, templateDelim) {
+			return s, nil
+		}
+		_, err := newTemplate(path, s)
+		return s, err
+	}
+	_, err := transformTemplates(s, fn)
+	return err
+}
+
+// renderTemplates returns a copy of the supplied PodMutationSpec in which the
+// Go template expressions in the string fields of its templates and patch
+// operations have been rendered using the supplied data.
+func renderTemplates(s PodMutationSpec, d TemplateData) (PodMutationSpec, error) {
+	fn := func(path, s string) (string, error) {
+		if !strings.Contains(s, templateDelim) {
+			return s, nil
+		}
+		t, err := newTemplate(path, s)
+		if err != nil {
+			return "", err
+		}
+		b := &bytes.Buffer{}
+		if err := t.Execute(b, d); err != nil {
+			return "", errors.Wrap(err, "cannot render template")
+		}
+		return b.String(), nil
+	}
+	return transformTemplates(s, fn)
+}
+
+func newTemplate(path, s string) (*template.Template, error) {
+	t, err := template.New(path).Option("missingkey=zero").Parse(s)
+	return t, errors.Wrap(err, "cannot parse template")
+}
+
+// transformTemplates returns a copy of the supplied PodMutationSpec in which
+// the supplied function has been applied to the string fields of its
+// templates and patch operations.
+func transformTemplates(s PodMutationSpec, fn stringFunc) (PodMutationSpec, error) {
+	out := *s.DeepCopy()
+	if err := transformStrings(s.Template, &out.Template, "spec.template", fn); err != nil {
+		return PodMutationSpec{}, err
+	}
+	if s.ContainerTemplate != nil {
+		if err := transformStrings(s.ContainerTemplate.Template, &out.ContainerTemplate.Template, "spec.containerTemplate.template", fn); err != nil {
+			return PodMutationSpec{}, err
+		}
+	}
+	if s.InitContainerTemplate != nil {
+		if err := transformStrings(s.InitContainerTemplate.Template, &out.InitContainerTemplate.Template, "spec.initContainerTemplate.template", fn); err != nil {
+			return PodMutationSpec{}, err
+		}
+	}
+	if s.EphemeralContainerTemplate != nil {
+		if err := transformStrings(s.EphemeralContainerTemplate.Template, &out.EphemeralContainerTemplate.Template, "spec.ephemeralContainerTemplate.template", fn); err != nil {
+			return PodMutationSpec{}, err
+		}
+	}
+	if err := transformStrings(s.Patch, &out.Patch, "spec.patch", fn); err != nil {
+		return PodMutationSpec{}, err
+	}
+	return out, nil
+}
+
+// transformStrings applies the supplied function to each string value of the
+// JSON encoding of in, decoding the result into out. out is left untouched if
+// in contains no template expressions.
+func transformStrings(in, out interface{}, path string, fn stringFunc) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode %s as JSON", path)
+	}
+	if !bytes.Contains(b, []byte(templateDelim)) {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return errors.Wrapf(err, "cannot decode %s", path)
+	}
+	v, err = walkStrings(v, path, fn)
+	if err != nil {
+		return err
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "cannot encode %s as JSON", path)
+	}
+
+	o := reflect.ValueOf(out).Elem()
+	o.Set(reflect.Zero(o.Type()))
+	return errors.Wrapf(json.Unmarshal(b, out), "cannot decode %s", path)
+}
+
+func walkStrings(v interface{}, path string, fn stringFunc) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		return fn(path, t)
+	case map[string]interface{}:
+		for k, e := range t {
+			r, err := walkStrings(e, path+"."+k, fn)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = r
+		}
+	case []interface{}:
+		for i, e := range t {
+			r, err := walkStrings(e, fmt.Sprintf("%s[%d]", path, i), fn)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+	return v, nil
+}
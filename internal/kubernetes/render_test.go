@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-test/deep"
+	authentication "k8s.io/api/authentication/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const podMutationTemplateFmt = `---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: templated
+spec:
+  strategy:
+    type: %s
+  template:
+    metadata:
+      labels:
+        injected-by: "{{ .UserInfo.Username }}"
+    spec:
+      nodeSelector:
+        cool: "{{ .Pod.Labels.cool }}"
+        namespace: "{{ .Namespace }}"
+`
+
+func TestRenderTemplates(t *testing.T) {
+	r := PodReview{
+		Pod:       coolPod,
+		Namespace: "coolnamespace",
+		UserInfo:  authentication.UserInfo{Username: "cooluser"},
+	}
+
+	cases := []struct {
+		name      string
+		spec      PodMutationSpec
+		want      []byte
+		wantError bool
+	}{
+		{
+			name: "Template",
+			spec: PodMutationSpec{Template: PodMutationTemplate{Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "sidecar", Args: []string{"--service-name={{ .Pod.Labels.cool }}", "--namespace={{ .Namespace }}"}}},
+			}}},
+			want: []byte(`[{"op":"add","path":"/spec/containers/1","value":{"args":["--service-name=true","--namespace=coolnamespace"],"name":"sidecar","resources":{}}}]`),
+		},
+		{
+			name: "ContainerTemplate",
+			spec: PodMutationSpec{ContainerTemplate: &ContainerTemplate{Template: core.Container{
+				Env: []core.EnvVar{{Name: "CONTAINERS", Value: "{{ len .Pod.Spec.Containers }}"}},
+			}}},
+			want: []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"CONTAINERS","value":"1"}]}]`),
+		},
+		{
+			name: "Patch",
+			spec: PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "add", Path: "/metadata/labels/{{ .UserInfo.Username }}", Value: &runtime.RawExtension{Raw: []byte(`"{{ .Pod.Name }}"`)}},
+			}},
+			want: []byte(`[{"op":"add","path":"/metadata/labels/cooluser","value":"coolpod"}]`),
+		},
+		{
+			name: "MissingKey",
+			spec: PodMutationSpec{Template: PodMutationTemplate{Spec: core.PodSpec{
+				NodeSelector: map[string]string{"pool": "{{ .Pod.Annotations.pool }}default"},
+			}}},
+			want: []byte(`[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"default"}}]`),
+		},
+		{
+			name: "ExecutionError",
+			spec: PodMutationSpec{Template: PodMutationTemplate{Spec: core.PodSpec{
+				NodeSelector: map[string]string{"pool": "{{ index .Pod.Spec.Containers 5 }}"},
+			}}},
+			wantError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := PodMutation{Spec: tc.spec}.Patch(r)
+			if err != nil {
+				if !tc.wantError {
+					t.Fatalf("m.Patch(...): %v", err)
+				}
+				return
+			}
+			if tc.wantError {
+				t.Fatalf("m.Patch(...): want error, got nil")
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("m.Patch(...): got != want:\n  got:  %s\n  want: %s\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRenderDecodedTemplates(t *testing.T) {
+	r := PodReview{
+		Pod:       coolPod,
+		Namespace: "coolnamespace",
+		UserInfo:  authentication.UserInfo{Username: "cooluser"},
+	}
+	want := []byte(`[{"op":"add","path":"/metadata/labels/injected-by","value":"cooluser"},{"op":"add","path":"/spec/nodeSelector","value":{"cool":"true","namespace":"coolnamespace"}}]`)
+
+	for _, strategy := range []PodMutationStrategyType{MergeStrategy, StrategicMergeStrategy} {
+		t.Run(string(strategy), func(t *testing.T) {
+			m, err := DecodePodMutation([]byte(fmt.Sprintf(podMutationTemplateFmt, strategy)))
+			if err != nil {
+				t.Fatalf("DecodePodMutation(...): %v", err)
+			}
+			got, err := m.Patch(r)
+			if err != nil {
+				t.Fatalf("m.Patch(...): %v", err)
+			}
+			if diff := deep.Equal(got, want); diff != nil {
+				t.Errorf("m.Patch(...): got != want:\n  got:  %s\n  want: %s\n", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidTemplate(t *testing.T) {
+	data := []byte(`---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: invalid
+spec:
+  template:
+    metadata:
+      labels:
+        cool: "{{ .Pod.Labels.cool "
+`)
+	if _, err := DecodePodMutation(data); err == nil {
+		t.Errorf("DecodePodMutation(...): want error, got nil")
+	}
+}
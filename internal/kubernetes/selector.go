@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// A PodMutationSelector determines which pods a PodMutation applies to. A pod
+// is selected only if it satisfies all of the selector's criteria. An empty
+// selector selects all pods.
+// +k8s:deepcopy-gen=true
+type PodMutationSelector struct {
+	// Select pods by their labels.
+	meta.LabelSelector `json:",inline"`
+
+	// MatchAnnotations selects pods with all of the supplied annotations.
+	MatchAnnotations map[string]string `json:"matchAnnotations,omitempty"`
+
+	// ExcludeAnnotations excludes pods with any of the supplied annotations.
+	ExcludeAnnotations map[string]string `json:"excludeAnnotations,omitempty"`
+
+	// Namespaces selects pods in any of the supplied namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// ExcludeNamespaces excludes pods in any of the supplied namespaces.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+
+	// NamespaceSelector selects pods by the labels of their namespace. Pods
+	// are not selected if the labels of their namespace are unknown, for
+	// example because Legion is not watching namespaces.
+	NamespaceSelector *meta.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ExcludeHostNetwork excludes pods running in the host network namespace.
+	ExcludeHostNetwork bool `json:"excludeHostNetwork,omitempty"`
+}
+
+// Selects returns true if the supplied pod is selected.
+func (s *PodMutationSelector) Selects(r PodReview) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+
+	ls, err := meta.LabelSelectorAsSelector(&s.LabelSelector)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot parse label selector")
+	}
+	if !ls.Matches(labels.Set(r.Pod.GetLabels())) {
+		return false, nil
+	}
+
+	a := r.Pod.GetAnnotations()
+	for k, v := range s.MatchAnnotations {
+		if av, ok := a[k]; !ok || av != v {
+			return false, nil
+		}
+	}
+	for k, v := range s.ExcludeAnnotations {
+		if av, ok := a[k]; ok && av == v {
+			return false, nil
+		}
+	}
+
+	if len(s.Namespaces) > 0 && !contains(s.Namespaces, r.Namespace) {
+		return false, nil
+	}
+	if contains(s.ExcludeNamespaces, r.Namespace) {
+		return false, nil
+	}
+
+	if s.NamespaceSelector != nil {
+		nl, err := r.namespaceLabelSet()
+		if err != nil {
+			return false, err
+		}
+		if nl == nil {
+			return false, nil
+		}
+		ns, err := meta.LabelSelectorAsSelector(s.NamespaceSelector)
+		if err != nil {
+			return false, errors.Wrap(err, "cannot parse namespace selector")
+		}
+		if !ns.Matches(nl) {
+			return false, nil
+		}
+	}
+
+	if s.ExcludeHostNetwork && r.Pod.Spec.HostNetwork {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, c := range ss {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
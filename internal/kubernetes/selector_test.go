@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestSelects(t *testing.T) {
+	cases := []struct {
+		name    string
+		s       *PodMutationSelector
+		r       PodReview
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "NilSelectorSelectsEverything",
+			r:    PodReview{Pod: coolPod, Namespace: "coolnamespace"},
+			want: true,
+		},
+		{
+			name: "EmptySelectorSelectsEverything",
+			s:    &PodMutationSelector{},
+			r:    PodReview{Pod: coolPod, Namespace: "coolnamespace"},
+			want: true,
+		},
+		{
+			name: "MatchLabels",
+			s: &PodMutationSelector{
+				LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}},
+			},
+			r:    PodReview{Pod: coolPod},
+			want: true,
+		},
+		{
+			name: "MatchLabelsNotMatched",
+			s: &PodMutationSelector{
+				LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": "false"}},
+			},
+			r:    PodReview{Pod: coolPod},
+			want: false,
+		},
+		{
+			name: "MatchExpressions",
+			s: &PodMutationSelector{
+				LabelSelector: meta.LabelSelector{MatchExpressions: []meta.LabelSelectorRequirement{{
+					Key:      "cool",
+					Operator: meta.LabelSelectorOpIn,
+					Values:   []string{"true", "very"},
+				}}},
+			},
+			r:    PodReview{Pod: coolPod},
+			want: true,
+		},
+		{
+			name: "InvalidMatchExpressions",
+			s: &PodMutationSelector{
+				LabelSelector: meta.LabelSelector{MatchExpressions: []meta.LabelSelectorRequirement{{
+					Key:      "cool",
+					Operator: "Cooler",
+				}}},
+			},
+			r:       PodReview{Pod: coolPod},
+			wantErr: true,
+		},
+		{
+			name: "MatchAnnotations",
+			s:    &PodMutationSelector{MatchAnnotations: map[string]string{"cool": "true"}},
+			r:    PodReview{Pod: coolPod},
+			want: true,
+		},
+		{
+			name: "MatchAnnotationsNotMatched",
+			s:    &PodMutationSelector{MatchAnnotations: map[string]string{"cool": "true", "cooler": "true"}},
+			r:    PodReview{Pod: coolPod},
+			want: false,
+		},
+		{
+			name: "ExcludeAnnotations",
+			s:    &PodMutationSelector{ExcludeAnnotations: map[string]string{"cool": "true"}},
+			r:    PodReview{Pod: coolPod},
+			want: false,
+		},
+		{
+			name: "Namespaces",
+			s:    &PodMutationSelector{Namespaces: []string{"coolnamespace", "coolernamespace"}},
+			r:    PodReview{Pod: coolPod, Namespace: "coolnamespace"},
+			want: true,
+		},
+		{
+			name: "NamespacesNotMatched",
+			s:    &PodMutationSelector{Namespaces: []string{"coolernamespace"}},
+			r:    PodReview{Pod: coolPod, Namespace: "coolnamespace"},
+			want: false,
+		},
+		{
+			name: "ExcludeNamespaces",
+			s:    &PodMutationSelector{ExcludeNamespaces: []string{"coolnamespace"}},
+			r:    PodReview{Pod: coolPod, Namespace: "coolnamespace"},
+			want: false,
+		},
+		{
+			name: "NamespaceSelector",
+			s: &PodMutationSelector{
+				NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"tenant": "cool"}},
+			},
+			r:    PodReview{Pod: coolPod, NamespaceLabels: labels.Set{"tenant": "cool"}},
+			want: true,
+		},
+		{
+			name: "NamespaceSelectorNotMatched",
+			s: &PodMutationSelector{
+				NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"tenant": "cool"}},
+			},
+			r:    PodReview{Pod: coolPod, NamespaceLabels: labels.Set{"tenant": "uncool"}},
+			want: false,
+		},
+		{
+			name: "NamespaceSelectorUnknownLabels",
+			s: &PodMutationSelector{
+				NamespaceSelector: &meta.LabelSelector{},
+			},
+			r:    PodReview{Pod: coolPod},
+			want: false,
+		},
+		{
+			name: "ExcludeHostNetwork",
+			s:    &PodMutationSelector{ExcludeHostNetwork: true},
+			r:    PodReview{Pod: core.Pod{Spec: core.PodSpec{HostNetwork: true}}},
+			want: false,
+		},
+		{
+			name: "ExcludeHostNetworkNotMatched",
+			s:    &PodMutationSelector{ExcludeHostNetwork: true},
+			r:    PodReview{Pod: coolPod},
+			want: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.s.Selects(tc.r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("tc.s.Selects(...): want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tc.s.Selects(...): %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v\n", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// An UnknownFieldPolicy determines how unknown and duplicate fields are
+// handled when decoding a PodMutation.
+type UnknownFieldPolicy string
+
+// Supported UnknownFieldPolicies.
+const (
+	// FailOnUnknownFields fails to decode PodMutations with unknown or
+	// duplicate fields.
+	FailOnUnknownFields UnknownFieldPolicy = "Fail"
+
+	// WarnOnUnknownFields logs a warning when decoding PodMutations with
+	// unknown or duplicate fields. Unknown fields are ignored, and the last
+	// of any duplicate fields is used.
+	WarnOnUnknownFields UnknownFieldPolicy = "Warn"
+)
+
+// A DecodeOption configures how a PodMutation is decoded.
+type DecodeOption func(o *decodeOptions)
+
+type decodeOptions struct {
+	l      *zap.Logger
+	policy UnknownFieldPolicy
+}
+
+// WithDecodeLogger configures decoding to log warnings to the supplied logger.
+func WithDecodeLogger(l *zap.Logger) DecodeOption {
+	return func(o *decodeOptions) {
+		o.l = l
+	}
+}
+
+// WithUnknownFieldPolicy configures how unknown and duplicate fields are
+// handled. PodMutations with unknown or duplicate fields fail to decode by
+// default.
+func WithUnknownFieldPolicy(p UnknownFieldPolicy) DecodeOption {
+	return func(o *decodeOptions) {
+		o.policy = p
+	}
+}
+
+// directivePrefix starts the keys of strategic merge patch directives, for
+// example $patch or $retainKeys.
+const directivePrefix = "$"
+
+var (
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	templateType    = reflect.TypeOf(PodMutationTemplate{})
+)
+
+// strictFields returns an error for each unknown or duplicate field of the
+// supplied YAML or JSON encoded PodMutation. Strategic merge patch directives
+// are permitted in the template only if directives is true.
+func strictFields(data []byte, directives bool) (field.ErrorList, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "cannot parse PodMutation")
+	}
+	return checkFields(doc, reflect.TypeOf(PodMutation{}), nil, directives, false), nil
+}
+
+// checkFields returns an error for each unknown or duplicate field of the
+// supplied value, which was decoded from YAML, when compared to the supplied
+// type. Values that do not match the shape of the type are ignored; they are
+// reported by the decoder.
+func checkFields(v interface{}, t reflect.Type, p *field.Path, directives, inTemplate bool) field.ErrorList {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == templateType {
+		inTemplate = true
+	} else if reflect.PtrTo(t).Implements(unmarshalerType) {
+		// Types that decode themselves (quantities, timestamps, raw
+		// extensions, etc) needn't be encoded as objects with known fields.
+		return nil
+	}
+
+	allErrs := field.ErrorList{}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return allErrs
+		}
+		fields := jsonFields(t)
+		allErrs = append(allErrs, duplicateKeys(m, p)...)
+		for _, item := range m {
+			k := fmt.Sprint(item.Key)
+			if directives && inTemplate && strings.HasPrefix(k, directivePrefix) {
+				continue
+			}
+			ft, ok := fields[k]
+			if !ok {
+				allErrs = append(allErrs, field.NotSupported(p.Child(k), k, fieldNames(fields)))
+				continue
+			}
+			allErrs = append(allErrs, checkFields(item.Value, ft, p.Child(k), directives, inTemplate)...)
+		}
+	case reflect.Map:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return allErrs
+		}
+		allErrs = append(allErrs, duplicateKeys(m, p)...)
+		for _, item := range m {
+			k := fmt.Sprint(item.Key)
+			if directives && inTemplate && strings.HasPrefix(k, directivePrefix) {
+				continue
+			}
+			allErrs = append(allErrs, checkFields(item.Value, t.Elem(), p.Key(k), directives, inTemplate)...)
+		}
+	case reflect.Slice, reflect.Array:
+		s, ok := v.([]interface{})
+		if !ok {
+			return allErrs
+		}
+		for i, e := range s {
+			allErrs = append(allErrs, checkFields(e, t.Elem(), p.Index(i), directives, inTemplate)...)
+		}
+	}
+	return allErrs
+}
+
+// duplicateKeys returns an error for each key of the supplied map that
+// appears more than once.
+func duplicateKeys(m yaml.MapSlice, p *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	seen := map[string]bool{}
+	for _, item := range m {
+		k := fmt.Sprint(item.Key)
+		if seen[k] {
+			allErrs = append(allErrs, field.Duplicate(p.Child(k), k))
+		}
+		seen[k] = true
+	}
+	return allErrs
+}
+
+// jsonFields returns the types of the supplied struct's fields, keyed by the
+// name with which they are encoded as JSON. The fields of inlined structs are
+// included.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		inline := f.Anonymous && name == ""
+		for _, opt := range tag[1:] {
+			inline = inline || opt == "inline"
+		}
+		if inline {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			for n, t := range jsonFields(ft) {
+				fields[n] = t
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported fields are not encoded.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// fieldNames returns the sorted names of the supplied fields.
+func fieldNames(fields map[string]reflect.Type) []string {
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
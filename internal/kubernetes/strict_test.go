@@ -0,0 +1,201 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+const misspelledPodMutationYAML = `
+---
+apiVersion: legion.planet.com/v1alpha1
+kind: PodMutation
+metadata:
+  name: cool
+spec:
+  strategy:
+    overwite: true
+  templat:
+    metadata:
+      labels:
+        cool: 'true'
+`
+
+func TestStrictFields(t *testing.T) {
+	cases := []struct {
+		name       string
+		data       string
+		directives bool
+		want       []string
+	}{
+		{
+			name: "Valid",
+			data: coolPodMutationYAML,
+			want: []string{},
+		},
+		{
+			name: "ValidJSON",
+			data: coolPodMutationJSON,
+			want: []string{},
+		},
+		{
+			name: "ValidSelector",
+			data: selectivePodMutationYAML,
+			want: []string{},
+		},
+		{
+			name: "Misspelled",
+			data: misspelledPodMutationYAML,
+			want: []string{
+				"spec.strategy.overwite: Unsupported value",
+				"spec.templat: Unsupported value",
+			},
+		},
+		{
+			name: "Duplicate",
+			data: `
+spec:
+  priority: 1
+  priority: 2
+  template:
+    metadata:
+      labels:
+        cool: 'true'
+        cool: 'false'
+`,
+			want: []string{
+				"spec.priority: Duplicate value",
+				"spec.template.metadata.labels.cool: Duplicate value",
+			},
+		},
+		{
+			name: "DuplicateJSON",
+			data: `{"spec": {"priority": 1, "priority": 2}}`,
+			want: []string{"spec.priority: Duplicate value"},
+		},
+		{
+			name: "NestedUnknown",
+			data: `
+spec:
+  template:
+    spec:
+      containers:
+      - name: cool
+        image: cool
+        resources:
+          limits:
+            cpu: 1
+      - name: cooler
+        imag: cooler
+  containerTemplate:
+    selector:
+      nme: cool
+  patch:
+  - op: add
+    path: /metadata/labels
+    value:
+      anything: goes
+    valu: cool
+`,
+			want: []string{
+				"spec.containerTemplate.selector.nme: Unsupported value",
+				"spec.patch[0].valu: Unsupported value",
+				"spec.template.spec.containers[1].imag: Unsupported value",
+			},
+		},
+		{
+			name: "InlineFields",
+			data: `
+spec:
+  selector:
+    matchLabels:
+      cool: 'true'
+    matchExpressions:
+    - key: cool
+      operator: Exists
+    namespaceSelector:
+      matchLabels:
+        cool: 'true'
+`,
+			want: []string{},
+		},
+		{
+			name: "DirectivesNotPermitted",
+			data: `
+spec:
+  template:
+    spec:
+      $retainKeys: [containers]
+      containers:
+      - name: cool
+        $patch: delete
+`,
+			want: []string{
+				"spec.template.spec.$retainKeys: Unsupported value",
+				"spec.template.spec.containers[0].$patch: Unsupported value",
+			},
+		},
+		{
+			name:       "DirectivesPermitted",
+			directives: true,
+			data: `
+spec:
+  $patch: replace
+  template:
+    spec:
+      $retainKeys: [containers]
+      containers:
+      - name: cool
+        $patch: delete
+`,
+			want: []string{"spec.$patch: Unsupported value"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs, err := strictFields([]byte(tc.data), tc.directives)
+			if err != nil {
+				t.Fatalf("strictFields(...): %v", err)
+			}
+			if diff := deep.Equal(problems(errs), tc.want); diff != nil {
+				t.Errorf("strictFields(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	data := []byte(misspelledPodMutationYAML)
+
+	if _, err := DecodePodMutation(data); err == nil {
+		t.Errorf("DecodePodMutation(...): want error, got nil")
+	}
+	if _, err := DecodePodMutation(data, WithUnknownFieldPolicy(FailOnUnknownFields)); err == nil {
+		t.Errorf("DecodePodMutation(..., WithUnknownFieldPolicy(%q)): want error, got nil", FailOnUnknownFields)
+	}
+
+	got, err := DecodePodMutation(data, WithUnknownFieldPolicy(WarnOnUnknownFields))
+	if err != nil {
+		t.Fatalf("DecodePodMutation(..., WithUnknownFieldPolicy(%q)): %v", WarnOnUnknownFields, err)
+	}
+	if got.Spec.Strategy.Overwrite || len(got.Spec.Template.GetLabels()) > 0 {
+		t.Errorf("DecodePodMutation(..., WithUnknownFieldPolicy(%q)): unknown fields were not ignored: %+v", WarnOnUnknownFields, got.Spec)
+	}
+}
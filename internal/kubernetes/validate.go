@@ -0,0 +1,383 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	admission "k8s.io/api/admission/v1"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	core "k8s.io/api/core/v1"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metavalidation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var jsonPatchOps = map[string]bool{"add": true, "remove": true, "replace": true, "move": true, "copy": true, "test": true}
+
+// ValidatePodMutation validates the supplied PodMutation.
+func ValidatePodMutation(m PodMutation) field.ErrorList {
+	return validatePodMutation(m, nil)
+}
+
+func validatePodMutation(m PodMutation, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if m.GetName() == "" {
+		errs = append(errs, field.Required(p.Child("metadata", "name"), ""))
+	}
+
+	sp := p.Child("spec")
+	errs = append(errs, validateMode(m.Spec.Mode, sp.Child("mode"))...)
+	errs = append(errs, validateOperations(m.Spec.Operations, sp.Child("operations"))...)
+	errs = append(errs, validateSelector(m.Spec.Selector, sp.Child("selector"))...)
+	errs = append(errs, validateStrategy(m.Spec, sp.Child("strategy"))...)
+	errs = append(errs, validateTemplate(m.Spec.Template, m.Spec.Strategy.Type, sp.Child("template"))...)
+	errs = append(errs, validateContainerTemplate(m.Spec.ContainerTemplate, sp.Child("containerTemplate"))...)
+	errs = append(errs, validateContainerTemplate(m.Spec.InitContainerTemplate, sp.Child("initContainerTemplate"))...)
+	errs = append(errs, validateEphemeralContainerTemplate(m.Spec, sp.Child("ephemeralContainerTemplate"))...)
+	errs = append(errs, validateJSONPatch(m.Spec.Patch, sp.Child("patch"))...)
+	if err := parseTemplates(m.Spec); err != nil {
+		errs = append(errs, field.Invalid(sp, "", err.Error()))
+	}
+	return errs
+}
+
+func validateMode(md PodMutationMode, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	switch md {
+	case "", EnforceMode, AuditMode:
+	default:
+		errs = append(errs, field.NotSupported(p, md, []string{string(EnforceMode), string(AuditMode)}))
+	}
+	return errs
+}
+
+func validateOperations(ops []admissionregistration.OperationType, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	seen := map[admissionregistration.OperationType]bool{}
+	for i, op := range ops {
+		switch op {
+		case admissionregistration.Create, admissionregistration.Update:
+		default:
+			errs = append(errs, field.NotSupported(p.Index(i), op, []string{string(admissionregistration.Create), string(admissionregistration.Update)}))
+		}
+		if seen[op] {
+			errs = append(errs, field.Duplicate(p.Index(i), op))
+		}
+		seen[op] = true
+	}
+	return errs
+}
+
+func validateSelector(s *PodMutationSelector, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if s == nil {
+		return errs
+	}
+	errs = append(errs, metavalidation.ValidateLabelSelector(&s.LabelSelector, p)...)
+	errs = append(errs, metavalidation.ValidateLabelSelector(s.NamespaceSelector, p.Child("namespaceSelector"))...)
+	for i, ns := range s.ExcludeNamespaces {
+		if contains(s.Namespaces, ns) {
+			errs = append(errs, field.Invalid(p.Child("excludeNamespaces").Index(i), ns, "namespace is both selected and excluded"))
+		}
+	}
+	for k, v := range s.ExcludeAnnotations {
+		if mv, ok := s.MatchAnnotations[k]; ok && mv == v {
+			errs = append(errs, field.Invalid(p.Child("excludeAnnotations").Key(k), v, "annotation is both matched and excluded"))
+		}
+	}
+	return errs
+}
+
+func validateStrategy(s PodMutationSpec, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	switch s.Strategy.Type {
+	case "", MergeStrategy:
+	case StrategicMergeStrategy:
+		// Overwrite and Append affect only container templates when using the
+		// StrategicMerge strategy.
+		if s.ContainerTemplate == nil && s.InitContainerTemplate == nil && s.EphemeralContainerTemplate == nil {
+			if s.Strategy.Overwrite {
+				errs = append(errs, field.Invalid(p.Child("overwrite"), true, "has no effect on the StrategicMerge strategy without a container template"))
+			}
+			if s.Strategy.Append {
+				errs = append(errs, field.Invalid(p.Child("append"), true, "has no effect on the StrategicMerge strategy without a container template"))
+			}
+		}
+	default:
+		errs = append(errs, field.NotSupported(p.Child("type"), s.Strategy.Type, []string{string(MergeStrategy), string(StrategicMergeStrategy)}))
+	}
+	return errs
+}
+
+func validateTemplate(t PodMutationTemplate, st PodMutationStrategyType, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	mp := p.Child("metadata")
+	errs = append(errs, metavalidation.ValidateLabels(withoutTemplates(t.GetLabels()), mp.Child("labels"))...)
+	errs = append(errs, apivalidation.ValidateAnnotations(withoutTemplates(t.GetAnnotations()), mp.Child("annotations"))...)
+
+	sp := p.Child("spec")
+	// Strategic merge patch directives such as '$patch: delete' reference
+	// containers only by name.
+	requireImage := st != StrategicMergeStrategy
+	names := map[string]bool{}
+	for i, c := range t.Spec.InitContainers {
+		cp := sp.Child("initContainers").Index(i)
+		errs = append(errs, validateUniqueName(c.Name, names, cp.Child("name"))...)
+		errs = append(errs, validateContainer(c, requireImage, cp)...)
+	}
+	for i, c := range t.Spec.Containers {
+		cp := sp.Child("containers").Index(i)
+		errs = append(errs, validateUniqueName(c.Name, names, cp.Child("name"))...)
+		errs = append(errs, validateContainer(c, requireImage, cp)...)
+	}
+
+	volumes := map[string]bool{}
+	for i, v := range t.Spec.Volumes {
+		errs = append(errs, validateUniqueName(v.Name, volumes, sp.Child("volumes").Index(i).Child("name"))...)
+	}
+	return errs
+}
+
+func validateContainerTemplate(t *ContainerTemplate, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if t == nil {
+		return errs
+	}
+	if t.Selector != nil && t.Selector.Name != "" {
+		if _, err := regexp.Compile(t.Selector.Name); err != nil {
+			errs = append(errs, field.Invalid(p.Child("selector", "name"), t.Selector.Name, err.Error()))
+		}
+	}
+	return append(errs, validateContainerFields(t.Template, p.Child("template"))...)
+}
+
+func validateEphemeralContainerTemplate(s PodMutationSpec, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	t := s.EphemeralContainerTemplate
+	if t == nil {
+		return errs
+	}
+	if !s.AppliesTo(admission.Update) {
+		errs = append(errs, field.Invalid(p, "", "has no effect unless operations include UPDATE"))
+	}
+	// Ephemeral containers may not specify ports, resources, probes, or
+	// lifecycle hooks.
+	tp := p.Child("template")
+	if len(t.Template.Ports) > 0 {
+		errs = append(errs, field.Forbidden(tp.Child("ports"), "may not be set for ephemeral containers"))
+	}
+	if len(t.Template.Resources.Limits) > 0 || len(t.Template.Resources.Requests) > 0 {
+		errs = append(errs, field.Forbidden(tp.Child("resources"), "may not be set for ephemeral containers"))
+	}
+	if t.Template.LivenessProbe != nil {
+		errs = append(errs, field.Forbidden(tp.Child("livenessProbe"), "may not be set for ephemeral containers"))
+	}
+	if t.Template.ReadinessProbe != nil {
+		errs = append(errs, field.Forbidden(tp.Child("readinessProbe"), "may not be set for ephemeral containers"))
+	}
+	if t.Template.StartupProbe != nil {
+		errs = append(errs, field.Forbidden(tp.Child("startupProbe"), "may not be set for ephemeral containers"))
+	}
+	if t.Template.Lifecycle != nil {
+		errs = append(errs, field.Forbidden(tp.Child("lifecycle"), "may not be set for ephemeral containers"))
+	}
+	return append(errs, validateContainerTemplate(t, p)...)
+}
+
+func validateUniqueName(name string, names map[string]bool, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	switch {
+	case name == "":
+		errs = append(errs, field.Required(p, ""))
+	case isTemplate(name):
+	case names[name]:
+		errs = append(errs, field.Duplicate(p, name))
+	default:
+		for _, msg := range validation.IsDNS1123Label(name) {
+			errs = append(errs, field.Invalid(p, name, msg))
+		}
+	}
+	names[name] = true
+	return errs
+}
+
+func validateContainer(c core.Container, requireImage bool, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if requireImage && c.Image == "" {
+		errs = append(errs, field.Required(p.Child("image"), "containers in a template may be added to pods; use a container template to modify existing containers"))
+	}
+	return append(errs, validateContainerFields(c, p)...)
+}
+
+// validateContainerFields validates the fields of a container other than its
+// name and image.
+func validateContainerFields(c core.Container, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	env := map[string]bool{}
+	for i, e := range c.Env {
+		ep := p.Child("env").Index(i).Child("name")
+		switch {
+		case e.Name == "":
+			errs = append(errs, field.Required(ep, ""))
+		case env[e.Name]:
+			errs = append(errs, field.Duplicate(ep, e.Name))
+		case isTemplate(e.Name):
+		default:
+			for _, msg := range validation.IsEnvVarName(e.Name) {
+				errs = append(errs, field.Invalid(ep, e.Name, msg))
+			}
+		}
+		env[e.Name] = true
+	}
+
+	mounts := map[string]bool{}
+	for i, m := range c.VolumeMounts {
+		mp := p.Child("volumeMounts").Index(i)
+		if m.Name == "" {
+			errs = append(errs, field.Required(mp.Child("name"), ""))
+		}
+		switch {
+		case m.MountPath == "":
+			errs = append(errs, field.Required(mp.Child("mountPath"), ""))
+		case mounts[m.MountPath]:
+			errs = append(errs, field.Duplicate(mp.Child("mountPath"), m.MountPath))
+		}
+		mounts[m.MountPath] = true
+	}
+
+	for i, port := range c.Ports {
+		pp := p.Child("ports").Index(i).Child("containerPort")
+		for _, msg := range validation.IsValidPortNum(int(port.ContainerPort)) {
+			errs = append(errs, field.Invalid(pp, port.ContainerPort, msg))
+		}
+	}
+
+	rp := p.Child("resources")
+	for name, q := range c.Resources.Limits {
+		if q.Sign() < 0 {
+			errs = append(errs, field.Invalid(rp.Child("limits").Key(string(name)), q.String(), "must be greater than or equal to 0"))
+		}
+	}
+	for name, q := range c.Resources.Requests {
+		qp := rp.Child("requests").Key(string(name))
+		if q.Sign() < 0 {
+			errs = append(errs, field.Invalid(qp, q.String(), "must be greater than or equal to 0"))
+		}
+		if l, ok := c.Resources.Limits[name]; ok && q.Cmp(l) > 0 {
+			errs = append(errs, field.Invalid(qp, q.String(), fmt.Sprintf("must be less than or equal to %s limit", name)))
+		}
+	}
+	return errs
+}
+
+func validateJSONPatch(ops []JSONPatchOperation, p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for i, op := range ops {
+		opp := p.Index(i)
+		if !jsonPatchOps[op.Op] {
+			errs = append(errs, field.NotSupported(opp.Child("op"), op.Op, []string{"add", "remove", "replace", "move", "copy", "test"}))
+		}
+		if !strings.HasPrefix(op.Path, "/") {
+			errs = append(errs, field.Invalid(opp.Child("path"), op.Path, "must be a JSON pointer beginning with '/'"))
+		}
+		switch op.Op {
+		case "move", "copy":
+			if !strings.HasPrefix(op.From, "/") {
+				errs = append(errs, field.Invalid(opp.Child("from"), op.From, "must be a JSON pointer beginning with '/'"))
+			}
+		case "add", "replace", "test":
+			if op.Value == nil {
+				errs = append(errs, field.Required(opp.Child("value"), ""))
+			}
+		}
+	}
+	return errs
+}
+
+// validateNoConflicts returns an error for each pod field that both of the
+// supplied PodMutations set when they have the same priority. Such mutations
+// are applied in order of name, which is rarely what was intended.
+func validateNoConflicts(a, b PodMutation) field.ErrorList {
+	errs := field.ErrorList{}
+	if a.Spec.Priority != b.Spec.Priority {
+		return errs
+	}
+
+	p := field.NewPath("spec", "template")
+	detail := fmt.Sprintf("conflicts with PodMutation %s, which has the same priority", a.GetName())
+	for k, v := range b.Spec.Template.GetLabels() {
+		if av, ok := a.Spec.Template.GetLabels()[k]; ok && av != v {
+			errs = append(errs, field.Invalid(p.Child("metadata", "labels").Key(k), v, detail))
+		}
+	}
+	for k, v := range b.Spec.Template.GetAnnotations() {
+		if av, ok := a.Spec.Template.GetAnnotations()[k]; ok && av != v {
+			errs = append(errs, field.Invalid(p.Child("metadata", "annotations").Key(k), v, detail))
+		}
+	}
+
+	sp := p.Child("spec")
+	containers := map[string]bool{}
+	for _, c := range append(a.Spec.Template.Spec.InitContainers, a.Spec.Template.Spec.Containers...) {
+		containers[c.Name] = true
+	}
+	for i, c := range b.Spec.Template.Spec.InitContainers {
+		if containers[c.Name] {
+			errs = append(errs, field.Invalid(sp.Child("initContainers").Index(i).Child("name"), c.Name, detail))
+		}
+	}
+	for i, c := range b.Spec.Template.Spec.Containers {
+		if containers[c.Name] {
+			errs = append(errs, field.Invalid(sp.Child("containers").Index(i).Child("name"), c.Name, detail))
+		}
+	}
+
+	volumes := map[string]bool{}
+	for _, v := range a.Spec.Template.Spec.Volumes {
+		volumes[v.Name] = true
+	}
+	for i, v := range b.Spec.Template.Spec.Volumes {
+		if volumes[v.Name] {
+			errs = append(errs, field.Invalid(sp.Child("volumes").Index(i).Child("name"), v.Name, detail))
+		}
+	}
+	return errs
+}
+
+// isTemplate returns true if the supplied string contains a Go template
+// expression, and thus cannot be validated until it is rendered.
+func isTemplate(s string) bool {
+	return strings.Contains(s, templateDelim)
+}
+
+// withoutTemplates returns a copy of the supplied map omitting any entries
+// that contain Go template expressions.
+func withoutTemplates(m map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range m {
+		if isTemplate(k) || isTemplate(v) {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
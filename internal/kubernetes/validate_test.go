@@ -0,0 +1,201 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/go-test/deep"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// problems returns the sorted field paths and types of the supplied errors.
+func problems(errs field.ErrorList) []string {
+	p := []string{}
+	for _, e := range errs {
+		p = append(p, fmt.Sprintf("%s: %s", e.Field, e.Type))
+	}
+	sort.Strings(p)
+	return p
+}
+
+func TestValidatePodMutation(t *testing.T) {
+	named := func(s PodMutationSpec) PodMutation {
+		return PodMutation{ObjectMeta: meta.ObjectMeta{Name: "cool"}, Spec: s}
+	}
+	containers := func(c ...core.Container) PodMutationTemplate {
+		return PodMutationTemplate{Spec: core.PodSpec{Containers: c}}
+	}
+
+	cases := []struct {
+		name string
+		m    PodMutation
+		want []string
+	}{
+		{
+			name: "Valid",
+			m:    coolPodMutation,
+			want: []string{},
+		},
+		{
+			name: "MissingName",
+			m:    PodMutation{},
+			want: []string{"metadata.name: Required value"},
+		},
+		{
+			name: "InvalidContainers",
+			m: named(PodMutationSpec{Template: containers(
+				core.Container{Name: "cool"},
+				core.Container{Name: "cool", Image: "cool"},
+				core.Container{Name: "Not_Cool", Image: "cool"},
+			)}),
+			want: []string{
+				"spec.template.spec.containers[0].image: Required value",
+				"spec.template.spec.containers[1].name: Duplicate value",
+				"spec.template.spec.containers[2].name: Invalid value",
+			},
+		},
+		{
+			name: "StrategicMergeContainerWithoutImage",
+			m: named(PodMutationSpec{
+				Strategy: PodMutationStrategy{Type: StrategicMergeStrategy},
+				Template: containers(core.Container{Name: "cool"}),
+			}),
+			want: []string{},
+		},
+		{
+			name: "InvalidContainerFields",
+			m: named(PodMutationSpec{Template: containers(core.Container{
+				Name:         "cool",
+				Image:        "cool",
+				Env:          []core.EnvVar{{Name: "COOL"}, {Name: "COOL"}, {Name: "1COOL"}},
+				VolumeMounts: []core.VolumeMount{{Name: "cool", MountPath: "/cool"}, {Name: "cooler", MountPath: "/cool"}},
+				Ports:        []core.ContainerPort{{ContainerPort: 70000}},
+				Resources: core.ResourceRequirements{
+					Requests: core.ResourceList{core.ResourceCPU: resource.MustParse("2")},
+					Limits:   core.ResourceList{core.ResourceCPU: resource.MustParse("1"), core.ResourceMemory: resource.MustParse("-1")},
+				},
+			})}),
+			want: []string{
+				"spec.template.spec.containers[0].env[1].name: Duplicate value",
+				"spec.template.spec.containers[0].env[2].name: Invalid value",
+				"spec.template.spec.containers[0].ports[0].containerPort: Invalid value",
+				"spec.template.spec.containers[0].resources.limits[memory]: Invalid value",
+				"spec.template.spec.containers[0].resources.requests[cpu]: Invalid value",
+				"spec.template.spec.containers[0].volumeMounts[1].mountPath: Duplicate value",
+			},
+		},
+		{
+			name: "InvalidMetadata",
+			m: named(PodMutationSpec{Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{
+				Labels: map[string]string{"cool": "not cool", "templated": "{{ .Pod.Name }}"},
+			}}}),
+			want: []string{"spec.template.metadata.labels: Invalid value"},
+		},
+		{
+			name: "InvalidMode",
+			m:    named(PodMutationSpec{Mode: "Cool"}),
+			want: []string{"spec.mode: Unsupported value"},
+		},
+		{
+			name: "InvalidOperations",
+			m: named(PodMutationSpec{Operations: []admissionregistration.OperationType{
+				admissionregistration.Update,
+				admissionregistration.Delete,
+				admissionregistration.Update,
+			}}),
+			want: []string{
+				"spec.operations[1]: Unsupported value",
+				"spec.operations[2]: Duplicate value",
+			},
+		},
+		{
+			name: "InvalidEphemeralContainerTemplate",
+			m: named(PodMutationSpec{EphemeralContainerTemplate: &ContainerTemplate{Template: core.Container{
+				Ports:         []core.ContainerPort{{ContainerPort: 80}},
+				LivenessProbe: &core.Probe{},
+			}}}),
+			want: []string{
+				"spec.ephemeralContainerTemplate.template.livenessProbe: Forbidden",
+				"spec.ephemeralContainerTemplate.template.ports: Forbidden",
+				"spec.ephemeralContainerTemplate: Invalid value",
+			},
+		},
+		{
+			name: "InvalidStrategy",
+			m:    named(PodMutationSpec{Strategy: PodMutationStrategy{Type: "Cool"}}),
+			want: []string{"spec.strategy.type: Unsupported value"},
+		},
+		{
+			name: "IneffectiveStrategy",
+			m:    named(PodMutationSpec{Strategy: PodMutationStrategy{Type: StrategicMergeStrategy, Overwrite: true}}),
+			want: []string{"spec.strategy.overwrite: Invalid value"},
+		},
+		{
+			name: "InvalidSelector",
+			m: named(PodMutationSpec{Selector: &PodMutationSelector{
+				Namespaces:        []string{"cool"},
+				ExcludeNamespaces: []string{"cool"},
+				NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"cool": "not cool"}},
+			}}),
+			want: []string{
+				"spec.selector.excludeNamespaces[0]: Invalid value",
+				"spec.selector.namespaceSelector.matchLabels: Invalid value",
+			},
+		},
+		{
+			name: "InvalidContainerTemplate",
+			m: named(PodMutationSpec{ContainerTemplate: &ContainerTemplate{
+				Selector: &ContainerSelector{Name: "("},
+				Template: core.Container{Env: []core.EnvVar{{Name: ""}}},
+			}}),
+			want: []string{
+				"spec.containerTemplate.selector.name: Invalid value",
+				"spec.containerTemplate.template.env[0].name: Required value",
+			},
+		},
+		{
+			name: "InvalidPatch",
+			m: named(PodMutationSpec{Patch: []JSONPatchOperation{
+				{Op: "cool", Path: "/cool"},
+				{Op: "add", Path: "cool"},
+				{Op: "move", Path: "/cool"},
+			}}),
+			want: []string{
+				"spec.patch[0].op: Unsupported value",
+				"spec.patch[1].path: Invalid value",
+				"spec.patch[1].value: Required value",
+				"spec.patch[2].from: Invalid value",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := problems(ValidatePodMutation(tc.m))
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("ValidatePodMutation(...): got != want: %v", diff)
+			}
+		})
+	}
+}
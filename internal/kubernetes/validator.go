@@ -0,0 +1,243 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/appscode/jsonpatch"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	admission "k8s.io/api/admission/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// A ValidationMode determines how a PodValidator handles pods that do not
+// conform to its PodMutations.
+type ValidationMode string
+
+// Validation modes.
+const (
+	// WarnValidation allows nonconforming pods, returning a warning for each
+	// field that does not conform.
+	WarnValidation ValidationMode = "Warn"
+
+	// EnforceValidation denies nonconforming pods.
+	EnforceValidation ValidationMode = "Enforce"
+)
+
+const (
+	tagResultAllowed = "allowed"
+	tagResultWarned  = "warned"
+	tagResultDenied  = "denied"
+)
+
+// maxViolationValueLength is the length to which the values included in
+// explanations of violations are truncated.
+const maxViolationValueLength = 64
+
+// simpleFieldName matches JSON pointer segments that can be represented as a
+// child of a field.Path, rather than a map key.
+var simpleFieldName = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9]*$")
+
+// A PodValidator is a Reviewer that validates that pods conform to
+// PodMutations, treating them as policy. A pod conforms if applying the
+// PodMutations to it would not change it.
+type PodValidator struct {
+	l    *zap.Logger
+	m    *PodMutator
+	mode ValidationMode
+}
+
+// A PodValidatorOption configures a PodValidator.
+type PodValidatorOption func(v *PodValidator)
+
+// WithValidatorLogger configures a PodValidator to use the supplied logger.
+func WithValidatorLogger(l *zap.Logger) PodValidatorOption {
+	return func(v *PodValidator) {
+		v.l = l
+	}
+}
+
+// WithValidationMode configures whether a PodValidator warns about (Warn) or
+// denies (Enforce) nonconforming pods. Defaults to Warn.
+func WithValidationMode(md ValidationMode) PodValidatorOption {
+	return func(v *PodValidator) {
+		v.mode = md
+	}
+}
+
+// WithMutatorOptions configures the PodMutator a PodValidator uses to
+// determine how pods would be mutated. Pods are never marked and their
+// provenance is never recorded during validation, and PodMutations in audit
+// mode are not enforced.
+func WithMutatorOptions(mo ...PodMutatorOption) PodValidatorOption {
+	return func(v *PodValidator) {
+		v.m = NewPodMutator(v.m.p, mo...)
+	}
+}
+
+// NewPodValidator returns a new PodValidator that validates pods against the
+// patches generated by the supplied Patcher.
+func NewPodValidator(p Patcher, o ...PodValidatorOption) *PodValidator {
+	v := &PodValidator{l: zap.NewNop(), m: NewPodMutator(p), mode: WarnValidation}
+	for _, fn := range o {
+		fn(v)
+	}
+	v.m.mode = EnforceMode
+	v.m.marker = ""
+	v.m.provenance, v.m.log = "", nil
+	v.m.unmeasured = true
+	return v
+}
+
+// Review allows pods that conform to the PodValidator's PodMutations. Pods
+// that do not conform are allowed with warnings, or denied, depending on the
+// PodValidator's mode. Either way each field that does not conform is
+// explained.
+func (v *PodValidator) Review(ar *admission.AdmissionRequest) *admission.AdmissionResponse {
+	dryRun := ar.DryRun != nil && *ar.DryRun
+	log := v.l.With(
+		zap.String("kind", ar.Kind.String()),
+		zap.String("namespace", ar.Namespace),
+		zap.String("name", ar.Name),
+		zap.Bool("dryRun", dryRun))
+
+	tags, _ := tag.New(context.Background(), // nolint:gosec
+		tag.Upsert(TagKind, ar.Kind.String()),
+		tag.Upsert(TagNamespace, ar.Namespace),
+		tag.Upsert(TagName, ar.Name),
+		tag.Upsert(TagDryRun, strconv.FormatBool(dryRun)))
+
+	rsp := v.m.Review(ar)
+	if !rsp.Allowed {
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
+		stats.Record(tags, MeasurePodsValidated.M(1))
+		return rsp
+	}
+
+	var violations []meta.StatusCause
+	if len(rsp.Patch) > 0 {
+		var err error
+		if violations, err = explainPatch(rsp.Patch); err != nil {
+			e := "cannot explain patch"
+			log.Info(e, zap.Error(err))
+			tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultError)) // nolint:gosec
+			stats.Record(tags, MeasurePodsValidated.M(1))
+			return admissionError(errors.Wrap(err, e), meta.StatusReasonInternalError)
+		}
+	}
+
+	if len(violations) == 0 {
+		log.Debug("pod conforms")
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultAllowed)) // nolint:gosec
+		stats.Record(tags, MeasurePodsValidated.M(1))
+		return &admission.AdmissionResponse{UID: ar.UID, Allowed: true}
+	}
+
+	msgs := make([]string, 0, len(violations))
+	for _, c := range violations {
+		msgs = append(msgs, c.Field+": "+c.Message)
+	}
+
+	if v.mode != EnforceValidation {
+		log.Info("pod does not conform", zap.Strings("violations", msgs))
+		tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultWarned)) // nolint:gosec
+		stats.Record(tags, MeasurePodsValidated.M(1))
+		return &admission.AdmissionResponse{UID: ar.UID, Allowed: true, Warnings: msgs}
+	}
+
+	log.Info("denied nonconforming pod", zap.Strings("violations", msgs))
+	tags, _ = tag.New(tags, tag.Upsert(TagResult, tagResultDenied)) // nolint:gosec
+	stats.Record(tags, MeasurePodsValidated.M(1))
+	return &admission.AdmissionResponse{
+		UID:     ar.UID,
+		Allowed: false,
+		Result: &meta.Status{
+			Status:  meta.StatusFailure,
+			Reason:  meta.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: "pod does not conform to PodMutations: " + strings.Join(msgs, "; "),
+			Details: &meta.StatusDetails{Causes: violations},
+		},
+	}
+}
+
+// explainPatch explains how each operation of the supplied RFC 6902 JSON patch
+// would change a field.
+func explainPatch(patch []byte) ([]meta.StatusCause, error) {
+	ops := []jsonpatch.Operation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(err, "cannot decode patch")
+	}
+	causes := make([]meta.StatusCause, 0, len(ops))
+	for _, op := range ops {
+		c := meta.StatusCause{Field: pointerToPath(op.Path).String()}
+		switch op.Operation {
+		case "remove":
+			c.Type, c.Message = meta.CauseTypeFieldValueNotSupported, "must not be set"
+		case "add":
+			c.Type, c.Message = meta.CauseTypeFieldValueRequired, "must be set to "+describeValue(op.Value)
+		default:
+			c.Type, c.Message = meta.CauseTypeFieldValueInvalid, "must be "+describeValue(op.Value)
+		}
+		causes = append(causes, c)
+	}
+	return causes, nil
+}
+
+// pointerToPath converts the supplied JSON pointer to a field path.
+func pointerToPath(pointer string) *field.Path {
+	var p *field.Path
+	for _, s := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		s = strings.NewReplacer("~1", "/", "~0", "~").Replace(s)
+		i, err := strconv.Atoi(s)
+		switch {
+		case p == nil:
+			p = field.NewPath(s)
+		case err == nil:
+			p = p.Index(i)
+		case simpleFieldName.MatchString(s):
+			p = p.Child(s)
+		default:
+			p = p.Key(s)
+		}
+	}
+	return p
+}
+
+// describeValue returns the supplied value encoded as JSON, truncated if it is
+// long.
+func describeValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	if len(b) > maxViolationValueLength {
+		return string(b[:maxViolationValueLength]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/go-test/deep"
+	admission "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPointerToPath(t *testing.T) {
+	cases := map[string]string{
+		"/spec/dnsPolicy":                            "spec.dnsPolicy",
+		"/spec/containers/0/env":                     "spec.containers[0].env",
+		"/metadata/annotations/cool.planet.com~1inj": "metadata.annotations[cool.planet.com/inj]",
+	}
+	for pointer, want := range cases {
+		if got := pointerToPath(pointer).String(); got != want {
+			t.Errorf("pointerToPath(%q): got %q, want %q", pointer, got, want)
+		}
+	}
+}
+
+func TestPodValidatorReview(t *testing.T) {
+	pms := PodMutations{{
+		ObjectMeta: meta.ObjectMeta{Name: "policy"},
+		Spec: PodMutationSpec{
+			Strategy: PodMutationStrategy{Overwrite: true},
+			Template: PodMutationTemplate{
+				ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"cool.planet.com/team": "cool"}},
+				Spec:       core.PodSpec{DNSPolicy: core.DNSDefault},
+			},
+		},
+	}}
+	encode := func(p *core.Pod) runtime.RawExtension {
+		b := &bytes.Buffer{}
+		serializer.Encode(p, b)
+		return runtime.RawExtension{Raw: b.Bytes()}
+	}
+	conforming := coolPod.DeepCopy()
+	conforming.Annotations["cool.planet.com/team"] = "cool"
+	conforming.Spec.DNSPolicy = core.DNSDefault
+
+	warnings := []string{
+		`metadata.annotations[cool.planet.com/team]: must be set to "cool"`,
+		`spec.dnsPolicy: must be "Default"`,
+	}
+
+	cases := []struct {
+		name    string
+		pod     *core.Pod
+		options []PodValidatorOption
+		want    *admission.AdmissionResponse
+	}{
+		{
+			name: "Conforming",
+			pod:  conforming,
+			want: &admission.AdmissionResponse{UID: "cool", Allowed: true},
+		},
+		{
+			name: "Warn",
+			pod:  &coolPod,
+			want: &admission.AdmissionResponse{UID: "cool", Allowed: true, Warnings: warnings},
+		},
+		{
+			name: "MarkersAreIgnored",
+			pod:  &coolPod,
+			// Markers and provenance would make every pod nonconforming.
+			options: []PodValidatorOption{WithMutatorOptions(WithMarker("marker"), WithProvenance("provenance", nil))},
+			want:    &admission.AdmissionResponse{UID: "cool", Allowed: true, Warnings: warnings},
+		},
+		{
+			name:    "Enforce",
+			pod:     &coolPod,
+			options: []PodValidatorOption{WithValidationMode(EnforceValidation)},
+			want: &admission.AdmissionResponse{
+				UID:     "cool",
+				Allowed: false,
+				Result: &meta.Status{
+					Status:  meta.StatusFailure,
+					Reason:  meta.StatusReasonForbidden,
+					Code:    http.StatusForbidden,
+					Message: "pod does not conform to PodMutations: " + warnings[0] + "; " + warnings[1],
+					Details: &meta.StatusDetails{Causes: []meta.StatusCause{
+						{Type: meta.CauseTypeFieldValueRequired, Field: "metadata.annotations[cool.planet.com/team]", Message: `must be set to "cool"`},
+						{Type: meta.CauseTypeFieldValueInvalid, Field: "spec.dnsPolicy", Message: `must be "Default"`},
+					}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NewPodValidator(pms, tc.options...).Review(&admission.AdmissionRequest{
+				UID:       "cool",
+				Resource:  resourcePod,
+				Operation: admission.Create,
+				Object:    encode(tc.pod),
+			})
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want: %v", diff)
+			}
+		})
+	}
+}
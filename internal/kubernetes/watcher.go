@@ -0,0 +1,353 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Resources of the PodMutation custom resources. ClusterPodMutations share
+// the schema of PodMutations, but are cluster scoped.
+var (
+	ResourcePodMutations        = SchemeGroupVersion.WithResource("podmutations")
+	ResourceClusterPodMutations = SchemeGroupVersion.WithResource("clusterpodmutations")
+)
+
+// The condition reported in the status of PodMutation custom resources.
+const (
+	ConditionReady = "Ready"
+
+	ReasonLoaded  = "Loaded"
+	ReasonInvalid = "Invalid"
+)
+
+const (
+	kindPodMutation        = "PodMutation"
+	kindClusterPodMutation = "ClusterPodMutation"
+	statusTimeout          = 10 * time.Second
+)
+
+// A PodMutationSource provides PodMutations.
+type PodMutationSource interface {
+	PodMutations() PodMutations
+}
+
+// PodMutationSources is a Patcher and Auditor that applies the PodMutations of several
+// sources to a pod, producing a single patch.
+type PodMutationSources []PodMutationSource
+
+// PodMutations returns the PodMutations of all sources, sorted by priority.
+func (s PodMutationSources) PodMutations() PodMutations {
+	pms := PodMutations{}
+	for _, src := range s {
+		pms = append(pms, src.PodMutations()...)
+	}
+	sort.Stable(ByPriority(pms))
+	return pms
+}
+
+// Patch generates an RFC 6902 JSON patch for the supplied pod using the
+// PodMutations of all sources.
+func (s PodMutationSources) Patch(pr PodReview) ([]byte, error) {
+	return s.PodMutations().Patch(pr)
+}
+
+// Audit generates an RFC 6902 JSON patch for the supplied pod using the
+// PodMutations of all sources, including those in audit mode.
+func (s PodMutationSources) Audit(pr PodReview) ([]byte, error) {
+	return s.PodMutations().Audit(pr)
+}
+
+// A PodMutationWatcher is a Patcher that watches the Kubernetes API for
+// PodMutation and ClusterPodMutation custom resources. Namespaced PodMutations
+// apply only to pods in their namespace. Each resource's Ready condition
+// reports whether it was loaded.
+type PodMutationWatcher struct {
+	client    dynamic.Interface
+	informers []resourceInformer
+	l         *zap.Logger
+	do        []DecodeOption
+	fn        []func(PodMutations)
+
+	mx      sync.Mutex
+	current atomic.Value // Always PodMutations.
+}
+
+// A resourceInformer watches a resource.
+type resourceInformer struct {
+	resource schema.GroupVersionResource
+	informer cache.SharedIndexInformer
+}
+
+// resourceStatus is the status of a PodMutation custom resource.
+type resourceStatus struct {
+	Conditions []meta.Condition `json:"conditions,omitempty"`
+}
+
+// A WatcherOption configures a PodMutationWatcher.
+type WatcherOption func(w *PodMutationWatcher)
+
+// WithWatcherLogger configures a PodMutationWatcher to use the supplied
+// logger.
+func WithWatcherLogger(l *zap.Logger) WatcherOption {
+	return func(w *PodMutationWatcher) {
+		w.l = l
+	}
+}
+
+// WithWatcherDecodeOptions configures a PodMutationWatcher to decode
+// PodMutations using the supplied DecodeOptions.
+func WithWatcherDecodeOptions(do ...DecodeOption) WatcherOption {
+	return func(w *PodMutationWatcher) {
+		w.do = do
+	}
+}
+
+// WithWatchFuncs configures a PodMutationWatcher to call the supplied
+// functions with the watched PodMutations whenever they change.
+func WithWatchFuncs(fn ...func(PodMutations)) WatcherOption {
+	return func(w *PodMutationWatcher) {
+		w.fn = append(w.fn, fn...)
+	}
+}
+
+// NewPodMutationWatcher returns a PodMutationWatcher that watches PodMutation
+// custom resources using the supplied client.
+func NewPodMutationWatcher(c dynamic.Interface, o ...WatcherOption) *PodMutationWatcher {
+	w := &PodMutationWatcher{client: c, l: zap.NewNop()}
+	for _, fn := range o {
+		fn(w)
+	}
+	w.current.Store(PodMutations{})
+
+	f := dynamicinformer.NewDynamicSharedInformerFactory(c, 0)
+	h := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(_ interface{}) { w.sync() },
+		UpdateFunc: func(_, _ interface{}) { w.sync() },
+		DeleteFunc: func(_ interface{}) { w.sync() },
+	}
+	for _, r := range []schema.GroupVersionResource{ResourcePodMutations, ResourceClusterPodMutations} {
+		i := f.ForResource(r).Informer()
+		i.AddEventHandler(h)
+		w.informers = append(w.informers, resourceInformer{resource: r, informer: i})
+	}
+	return w
+}
+
+// Patch generates an RFC 6902 JSON patch for the supplied pod using the
+// watched PodMutations.
+func (w *PodMutationWatcher) Patch(pr PodReview) ([]byte, error) {
+	return w.PodMutations().Patch(pr)
+}
+
+// Audit generates an RFC 6902 JSON patch for the supplied pod using the
+// watched PodMutations, including those in audit mode.
+func (w *PodMutationWatcher) Audit(pr PodReview) ([]byte, error) {
+	return w.PodMutations().Audit(pr)
+}
+
+// PodMutations returns the watched PodMutations that were successfully loaded.
+func (w *PodMutationWatcher) PodMutations() PodMutations {
+	return w.current.Load().(PodMutations)
+}
+
+// Run the PodMutationWatcher until the supplied context is done.
+func (w *PodMutationWatcher) Run(ctx context.Context) error {
+	for _, ri := range w.informers {
+		go ri.informer.Run(ctx.Done())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Synced returns true if the PodMutationWatcher has synced with the API.
+func (w *PodMutationWatcher) Synced() bool {
+	for _, ri := range w.informers {
+		if !ri.informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForSync blocks until the PodMutationWatcher has synced with the API, then
+// loads the watched PodMutations. It returns false if the supplied context is
+// done before the PodMutationWatcher syncs.
+func (w *PodMutationWatcher) WaitForSync(ctx context.Context) bool {
+	if !cache.WaitForCacheSync(ctx.Done(), w.Synced) {
+		return false
+	}
+	w.sync()
+	return true
+}
+
+// A statusUpdate is a resource whose status must be updated.
+type statusUpdate struct {
+	resource schema.GroupVersionResource
+	object   *unstructured.Unstructured
+}
+
+// sync loads every watched resource, reporting whether each could be loaded
+// in its status. Events received before the informers sync are ignored; the
+// watched resources are loaded once by WaitForSync.
+func (w *PodMutationWatcher) sync() {
+	if !w.Synced() {
+		return
+	}
+	// Statuses are updated without holding the lock; updating them causes
+	// further events.
+	for _, su := range w.reload() {
+		w.updateStatus(su)
+	}
+}
+
+// reload loads every watched resource, calling the watch funcs if the loaded
+// PodMutations changed. It returns the resources whose Ready condition must be
+// updated.
+func (w *PodMutationWatcher) reload() []statusUpdate {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	pms := PodMutations{}
+	updates := []statusUpdate{}
+	for _, ri := range w.informers {
+		for _, obj := range ri.informer.GetStore().List() {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			pm, err := w.load(ri.resource, u)
+			if ru := w.readyStatus(u, err); ru != nil {
+				updates = append(updates, statusUpdate{resource: ri.resource, object: ru})
+			}
+			if err != nil {
+				w.l.Info("cannot load PodMutation", zap.String("kind", u.GetKind()), zap.String("namespace", u.GetNamespace()), zap.String("name", u.GetName()), zap.Error(err))
+				continue
+			}
+			pms = append(pms, pm)
+		}
+	}
+	sort.Stable(ByPriority(pms))
+
+	if changed, err := differ(w.PodMutations(), pms); err == nil && !changed {
+		return updates
+	}
+	w.current.Store(pms)
+	w.l.Info("loaded PodMutations from the Kubernetes API", zap.Int("mutations", len(pms)))
+	for _, fn := range w.fn {
+		fn(pms)
+	}
+	return updates
+}
+
+// load decodes and validates the supplied resource.
+func (w *PodMutationWatcher) load(r schema.GroupVersionResource, u *unstructured.Unstructured) (PodMutation, error) {
+	u = u.DeepCopy()
+	u.SetKind(kindPodMutation)
+	unstructured.RemoveNestedField(u.Object, "status")
+	data, err := u.MarshalJSON()
+	if err != nil {
+		return PodMutation{}, errors.Wrap(err, "cannot encode resource")
+	}
+	pm, err := DecodePodMutation(data, w.do...)
+	if err != nil {
+		return PodMutation{}, err
+	}
+	if errs := ValidatePodMutation(pm); len(errs) > 0 {
+		return PodMutation{}, errs.ToAggregate()
+	}
+	pm.source = sourcePodMutation
+	if r == ResourceClusterPodMutations {
+		pm.source = sourceClusterPodMutation
+	}
+	return pm, nil
+}
+
+// readyStatus returns a copy of the supplied resource with an updated Ready
+// condition, or nil if its Ready condition has not changed.
+func (w *PodMutationWatcher) readyStatus(u *unstructured.Unstructured, loadErr error) *unstructured.Unstructured {
+	c := meta.Condition{
+		Type:               ConditionReady,
+		Status:             meta.ConditionTrue,
+		Reason:             ReasonLoaded,
+		Message:            "PodMutation was loaded.",
+		ObservedGeneration: u.GetGeneration(),
+	}
+	if loadErr != nil {
+		c.Status, c.Reason, c.Message = meta.ConditionFalse, ReasonInvalid, loadErr.Error()
+	}
+
+	status := resourceStatus{}
+	if s, ok := u.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(s, &status); err != nil {
+			w.l.Info("cannot parse PodMutation status", zap.String("namespace", u.GetNamespace()), zap.String("name", u.GetName()), zap.Error(err))
+		}
+	}
+	if existing := apimeta.FindStatusCondition(status.Conditions, ConditionReady); existing != nil &&
+		existing.Status == c.Status && existing.Reason == c.Reason &&
+		existing.Message == c.Message && existing.ObservedGeneration == c.ObservedGeneration {
+		return nil
+	}
+	apimeta.SetStatusCondition(&status.Conditions, c)
+
+	s, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		w.l.Info("cannot encode PodMutation status", zap.String("namespace", u.GetNamespace()), zap.String("name", u.GetName()), zap.Error(err))
+		return nil
+	}
+	u = u.DeepCopy()
+	u.Object["status"] = s
+	return u
+}
+
+// updateStatus updates the status of the supplied resource.
+func (w *PodMutationWatcher) updateStatus(su statusUpdate) {
+	u := su.object
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	if _, err := w.client.Resource(su.resource).Namespace(u.GetNamespace()).UpdateStatus(ctx, u, meta.UpdateOptions{}); err != nil {
+		w.l.Info("cannot update PodMutation status", zap.String("namespace", u.GetNamespace()), zap.String("name", u.GetName()), zap.Error(err))
+	}
+}
+
+// differ returns true if the supplied PodMutations differ.
+func differ(a, b PodMutations) (bool, error) {
+	ha, err := hashPodMutations(a)
+	if err != nil {
+		return true, err
+	}
+	hb, err := hashPodMutations(b)
+	if err != nil {
+		return true, err
+	}
+	return ha != hb, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func podMutationResource(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetAPIVersion(SchemeGroupVersion.String())
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func annotating(k string) map[string]interface{} {
+	return map[string]interface{}{
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{k: "true"},
+			},
+		},
+	}
+}
+
+func TestPodMutationWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		podMutationResource("ClusterPodMutation", "", "cluster", annotating("cluster")),
+		podMutationResource("PodMutation", "coolnamespace", "team", annotating("team")),
+		podMutationResource("PodMutation", "coolnamespace", "broken", map[string]interface{}{"cool": true}),
+	)
+
+	changed := make(chan PodMutations, 10)
+	w := NewPodMutationWatcher(client, WithWatchFuncs(func(pms PodMutations) { changed <- pms }))
+	go w.Run(ctx) // nolint:errcheck
+	if !w.WaitForSync(ctx) {
+		t.Fatal("w.WaitForSync(): watcher did not sync")
+	}
+
+	names := func(pms PodMutations) []string {
+		n := []string{}
+		for _, pm := range pms {
+			n = append(n, pm.GetNamespace()+"/"+pm.GetName())
+		}
+		return n
+	}
+
+	// Invalid resources are not loaded.
+	if diff := deep.Equal(names(w.PodMutations()), []string{"/cluster", "coolnamespace/team"}); diff != nil {
+		t.Errorf("w.PodMutations(): got != want: %v", diff)
+	}
+
+	// Namespaced PodMutations apply only to pods in their namespace.
+	for ns, want := range map[string]string{
+		"coolnamespace":   `[{"op":"add","path":"/metadata/annotations","value":{"cluster":"true","team":"true"}}]`,
+		"uncoolnamespace": `[{"op":"add","path":"/metadata/annotations","value":{"cluster":"true"}}]`,
+	} {
+		got, err := w.Patch(PodReview{Namespace: ns})
+		if err != nil {
+			t.Errorf("w.Patch(%s): %v", ns, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("w.Patch(%s):\ngot:  %s\nwant: %s", ns, got, want)
+		}
+	}
+
+	// Each resource reports whether it was loaded.
+	for _, tc := range []struct {
+		r          schema.GroupVersionResource
+		ns, name   string
+		wantStatus meta.ConditionStatus
+		wantReason string
+	}{
+		{r: ResourceClusterPodMutations, name: "cluster", wantStatus: meta.ConditionTrue, wantReason: ReasonLoaded},
+		{r: ResourcePodMutations, ns: "coolnamespace", name: "team", wantStatus: meta.ConditionTrue, wantReason: ReasonLoaded},
+		{r: ResourcePodMutations, ns: "coolnamespace", name: "broken", wantStatus: meta.ConditionFalse, wantReason: ReasonInvalid},
+	} {
+		u, err := client.Resource(tc.r).Namespace(tc.ns).Get(ctx, tc.name, meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get %s %s/%s: %v", tc.r.Resource, tc.ns, tc.name, err)
+		}
+		status := resourceStatus{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object["status"].(map[string]interface{}), &status); err != nil {
+			t.Fatalf("%s/%s: cannot parse status: %v", tc.ns, tc.name, err)
+		}
+		c := apimeta.FindStatusCondition(status.Conditions, ConditionReady)
+		if c == nil {
+			t.Errorf("%s/%s: missing %s condition", tc.ns, tc.name, ConditionReady)
+			continue
+		}
+		if c.Status != tc.wantStatus || c.Reason != tc.wantReason {
+			t.Errorf("%s/%s: got %s condition %s (%s), want %s (%s)", tc.ns, tc.name, ConditionReady, c.Status, c.Reason, tc.wantStatus, tc.wantReason)
+		}
+	}
+
+	// Changes to the watched resources are loaded.
+	if err := client.Resource(ResourceClusterPodMutations).Delete(ctx, "cluster", meta.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete cluster: %v", err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pms := <-changed:
+			if deep.Equal(names(pms), []string{"coolnamespace/team"}) == nil {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("w.PodMutations(): got %v after deleting ClusterPodMutation", names(w.PodMutations()))
+		}
+	}
+}
@@ -21,7 +21,15 @@ import (
 	"net/http"
 
 	"github.com/pkg/errors"
-	admission "k8s.io/api/admission/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	admissionReviewV1      = admission.SchemeGroupVersion.WithKind("AdmissionReview")
+	admissionReviewV1beta1 = admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
 )
 
 // A Reviewer reviews admission requests.
@@ -30,7 +38,9 @@ type Reviewer interface {
 }
 
 // AdmissionReviewWebhook returns a new admission review webhook. Admission
-// requests are reviewed by the supplied Reviewer.
+// requests are reviewed by the supplied Reviewer. Both admission.k8s.io/v1 and
+// admission.k8s.io/v1beta1 admission reviews are supported; the response is
+// encoded using the version of the request.
 func AdmissionReviewWebhook(r Reviewer) http.HandlerFunc {
 	return func(w http.ResponseWriter, rq *http.Request) {
 		b, err := ioutil.ReadAll(rq.Body)
@@ -42,15 +52,37 @@ func AdmissionReviewWebhook(r Reviewer) http.HandlerFunc {
 			http.Error(w, "cannot parse empty request body", http.StatusBadRequest)
 			return
 		}
+
+		// The v1 and v1beta1 AdmissionReview types are identical on the wire, so
+		// we decode either version into the v1 type and note which version we
+		// were sent in order to reply in kind.
 		ar := &admission.AdmissionReview{}
-		if _, _, err := serializer.Decode(b, nil, ar); err != nil {
+		_, gvk, err := serializer.Decode(b, nil, ar)
+		if err != nil {
 			http.Error(w, errors.Wrap(err, "cannot decode request body as admission review").Error(), http.StatusBadRequest)
 			return
 		}
+		if !supportedAdmissionReview(*gvk) {
+			http.Error(w, errors.Errorf("unsupported admission review version %q", gvk.String()).Error(), http.StatusBadRequest)
+			return
+		}
 		if ar.Request == nil {
 			http.Error(w, "admission review must contain a request", http.StatusBadRequest)
 			return
 		}
-		serializer.Encode(&admission.AdmissionReview{Response: r.Review(ar.Request)}, w) // nolint:gosec,errcheck
+
+		rsp := r.Review(ar.Request)
+		if rsp == nil {
+			rsp = admissionError(errors.New("reviewer returned no response"), meta.StatusReasonInternalError)
+		}
+		rsp.UID = ar.Request.UID
+		serializer.Encode(&admission.AdmissionReview{ // nolint:gosec,errcheck
+			TypeMeta: meta.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind},
+			Response: rsp,
+		}, w)
 	}
 }
+
+func supportedAdmissionReview(gvk schema.GroupVersionKind) bool {
+	return gvk == admissionReviewV1 || gvk == admissionReviewV1beta1
+}
@@ -24,7 +24,14 @@ import (
 	"testing"
 
 	"github.com/go-test/deep"
-	admission "k8s.io/api/admission/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	typeMetaV1      = meta.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	typeMetaV1beta1 = meta.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}
 )
 
 type predictableReviewer struct {
@@ -54,27 +61,67 @@ func TestAdmissionControlWebhook(t *testing.T) {
 			body: []byte("imastring!"),
 			want: []byte("cannot decode request body as admission review: couldn't get version/kind; json parse error: invalid character 'i' looking for beginning of value\n"),
 		},
+		{
+			name: "UnsupportedAdmissionReviewVersion",
+			r:    &predictableReviewer{&admission.AdmissionResponse{Allowed: true}},
+			body: func() []byte {
+				b := &bytes.Buffer{}
+				serializer.Encode(&admission.AdmissionReview{
+					TypeMeta: meta.TypeMeta{APIVersion: "admission.k8s.io/v2", Kind: "AdmissionReview"},
+					Request:  &admission.AdmissionRequest{},
+				}, b)
+				return b.Bytes()
+			}(),
+			want: []byte("unsupported admission review version \"admission.k8s.io/v2, Kind=AdmissionReview\"\n"),
+		},
 		{
 			name: "MissingAdmissionRequest",
 			r:    &predictableReviewer{&admission.AdmissionResponse{Allowed: true}},
 			body: func() []byte {
 				b := &bytes.Buffer{}
-				serializer.Encode(&admission.AdmissionReview{}, b)
+				serializer.Encode(&admission.AdmissionReview{TypeMeta: typeMetaV1}, b)
 				return b.Bytes()
 			}(),
 			want: []byte("admission review must contain a request\n"),
 		},
 		{
-			name: "PodAdmitted",
+			name: "PodAdmittedV1",
 			r:    &predictableReviewer{&admission.AdmissionResponse{Allowed: true}},
 			body: func() []byte {
 				b := &bytes.Buffer{}
 				serializer.Encode(&admission.AdmissionReview{
-					Request: &admission.AdmissionRequest{},
+					TypeMeta: typeMetaV1,
+					Request:  &admission.AdmissionRequest{UID: "cooluid"},
+				}, b)
+				return b.Bytes()
+			}(),
+			want: []byte("{\"kind\":\"AdmissionReview\",\"apiVersion\":\"admission.k8s.io/v1\",\"response\":{\"uid\":\"cooluid\",\"allowed\":true}}\n"),
+		},
+		{
+			name: "PodAdmittedV1beta1",
+			r:    &predictableReviewer{&admission.AdmissionResponse{Allowed: true}},
+			body: func() []byte {
+				b := &bytes.Buffer{}
+				serializer.Encode(&admissionv1beta1.AdmissionReview{
+					TypeMeta: typeMetaV1beta1,
+					Request:  &admissionv1beta1.AdmissionRequest{UID: "cooluid"},
+				}, b)
+				return b.Bytes()
+			}(),
+			want: []byte("{\"kind\":\"AdmissionReview\",\"apiVersion\":\"admission.k8s.io/v1beta1\",\"response\":{\"uid\":\"cooluid\",\"allowed\":true}}\n"),
+		},
+		{
+			name: "NoResponse",
+			r:    &predictableReviewer{},
+			body: func() []byte {
+				b := &bytes.Buffer{}
+				serializer.Encode(&admission.AdmissionReview{
+					TypeMeta: typeMetaV1,
+					Request:  &admission.AdmissionRequest{UID: "cooluid"},
 				}, b)
 				return b.Bytes()
 			}(),
-			want: []byte("{\"response\":{\"uid\":\"\",\"allowed\":true}}\n"),
+			want: []byte("{\"kind\":\"AdmissionReview\",\"apiVersion\":\"admission.k8s.io/v1\",\"response\":{\"uid\":\"cooluid\",\"allowed\":false,\"status\":{\"metadata\":{},\"status\":\"Failure\",\"message\":\"reviewer returned no response\",\"reason\":\"InternalError\"}}}\n"),
 		},
 	}
 
@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	admission "k8s.io/api/admission/v1"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// namespaceNameLabel is set to the name of each namespace by Kubernetes 1.21
+// and later. Earlier versions do not set it, so it may only be used to exclude
+// namespaces; a NotIn requirement matches namespaces without the label.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// DefaultWebhookTimeoutSeconds is the default time the API server waits for
+// Legion to review a pod.
+const DefaultWebhookTimeoutSeconds int32 = 10
+
+// A WebhookOption configures a MutatingWebhook.
+type WebhookOption func(w *admissionregistration.MutatingWebhook)
+
+// WithFailurePolicy configures how the API server handles pods it cannot send
+// to Legion for review. Defaults to Fail.
+func WithFailurePolicy(p admissionregistration.FailurePolicyType) WebhookOption {
+	return func(w *admissionregistration.MutatingWebhook) {
+		w.FailurePolicy = &p
+	}
+}
+
+// WithTimeoutSeconds configures how long the API server waits for Legion to
+// review a pod.
+func WithTimeoutSeconds(s int32) WebhookOption {
+	return func(w *admissionregistration.MutatingWebhook) {
+		w.TimeoutSeconds = &s
+	}
+}
+
+// WithReinvocationPolicy configures whether the API server sends pods to Legion
+// again if they are modified by other webhooks after Legion reviews them.
+// Defaults to Never.
+func WithReinvocationPolicy(p admissionregistration.ReinvocationPolicyType) WebhookOption {
+	return func(w *admissionregistration.MutatingWebhook) {
+		w.ReinvocationPolicy = &p
+	}
+}
+
+// NewMutatingWebhookConfiguration returns a MutatingWebhookConfiguration that
+// configures the API server to send pods to the supplied service for review
+// when they are created, and when they are updated or have ephemeral
+// containers added if any of the supplied PodMutations apply to updates. The
+// webhook's object and namespace selectors are derived from the supplied
+// PodMutations, such that it is invoked for every pod that could be selected by
+// at least one of them.
+func NewMutatingWebhookConfiguration(name string, svc admissionregistration.ServiceReference, caBundle []byte, pms PodMutations, o ...WebhookOption) *admissionregistration.MutatingWebhookConfiguration {
+	scope := admissionregistration.NamespacedScope
+	rule := func(resource string, ops ...admissionregistration.OperationType) admissionregistration.RuleWithOperations {
+		return admissionregistration.RuleWithOperations{
+			Operations: ops,
+			Rule: admissionregistration.Rule{
+				APIGroups:   []string{resourcePod.Group},
+				APIVersions: []string{resourcePod.Version},
+				Resources:   []string{resource},
+				Scope:       &scope,
+			},
+		}
+	}
+
+	update, ephemeral := false, false
+	for _, pm := range pms {
+		if pm.Spec.AppliesTo(admission.Update) {
+			update = true
+			ephemeral = ephemeral || pm.Spec.EphemeralContainerTemplate != nil
+		}
+	}
+	rules := []admissionregistration.RuleWithOperations{rule(resourcePod.Resource, admissionregistration.Create)}
+	if update {
+		rules[0].Operations = append(rules[0].Operations, admissionregistration.Update)
+	}
+	if ephemeral {
+		rules = append(rules, rule(resourcePod.Resource+"/"+subResourceEphemeralContainers, admissionregistration.Update))
+	}
+	w := newMutatingWebhook(name, svc, caBundle, rules, pms, o...)
+	w.ObjectSelector = objectSelector(pms)
+
+	return &admissionregistration.MutatingWebhookConfiguration{
+		TypeMeta: meta.TypeMeta{
+			APIVersion: admissionregistration.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: meta.ObjectMeta{Name: name},
+		Webhooks:   []admissionregistration.MutatingWebhook{w},
+	}
+}
+
+// WorkloadWebhookName returns the name of the webhook that sends workloads to
+// Legion, given the name of its MutatingWebhookConfiguration.
+func WorkloadWebhookName(name string) string {
+	return "workloads." + name
+}
+
+// NewWorkloadMutatingWebhook returns a MutatingWebhook that configures the API
+// server to send workloads, such as Deployments, to the supplied service for
+// review when they are created or updated. Jobs are sent only when they are
+// created, because their pod templates are immutable. The webhook has no
+// object selector, because the labels of a workload need not match those of
+// its pod template. Its namespace selector is derived from the supplied
+// PodMutations.
+func NewWorkloadMutatingWebhook(name string, svc admissionregistration.ServiceReference, caBundle []byte, pms PodMutations, o ...WebhookOption) admissionregistration.MutatingWebhook {
+	var (
+		scope          = admissionregistration.NamespacedScope
+		createOrUpdate = []admissionregistration.OperationType{admissionregistration.Create, admissionregistration.Update}
+		create         = []admissionregistration.OperationType{admissionregistration.Create}
+	)
+	rule := func(group string, resources ...string) admissionregistration.Rule {
+		return admissionregistration.Rule{
+			APIGroups:   []string{group},
+			APIVersions: []string{"*"},
+			Resources:   resources,
+			Scope:       &scope,
+		}
+	}
+	rules := []admissionregistration.RuleWithOperations{
+		{Operations: createOrUpdate, Rule: rule("apps", "deployments", "statefulsets", "daemonsets", "replicasets")},
+		{Operations: createOrUpdate, Rule: rule("batch", "cronjobs")},
+		{Operations: create, Rule: rule("batch", "jobs")},
+	}
+	return newMutatingWebhook(name, svc, caBundle, rules, pms, o...)
+}
+
+// newMutatingWebhook returns a MutatingWebhook with the supplied rules and a
+// namespace selector derived from the supplied PodMutations.
+func newMutatingWebhook(name string, svc admissionregistration.ServiceReference, caBundle []byte, rules []admissionregistration.RuleWithOperations, pms PodMutations, o ...WebhookOption) admissionregistration.MutatingWebhook {
+	var (
+		fail    = admissionregistration.Fail
+		none    = admissionregistration.SideEffectClassNone
+		timeout = DefaultWebhookTimeoutSeconds
+	)
+	w := admissionregistration.MutatingWebhook{
+		Name:                    name,
+		ClientConfig:            admissionregistration.WebhookClientConfig{Service: &svc, CABundle: caBundle},
+		Rules:                   rules,
+		FailurePolicy:           &fail,
+		SideEffects:             &none,
+		TimeoutSeconds:          &timeout,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		NamespaceSelector:       namespaceSelector(pms),
+	}
+	for _, fn := range o {
+		fn(&w)
+	}
+	return w
+}
+
+// objectSelector returns a label selector that selects every pod that could be
+// selected by at least one of the supplied PodMutations.
+func objectSelector(pms PodMutations) *meta.LabelSelector {
+	rs := make([][]meta.LabelSelectorRequirement, 0, len(pms))
+	for _, pm := range pms {
+		if pm.Spec.Selector == nil {
+			return &meta.LabelSelector{}
+		}
+		rs = append(rs, requirements(&pm.Spec.Selector.LabelSelector))
+	}
+	return commonSelector(rs)
+}
+
+// namespaceSelector returns a label selector that selects every namespace in
+// which a pod could be selected by at least one of the supplied PodMutations.
+func namespaceSelector(pms PodMutations) *meta.LabelSelector {
+	rs := make([][]meta.LabelSelectorRequirement, 0, len(pms))
+	for _, pm := range pms {
+		s := pm.Spec.Selector
+		if s == nil {
+			return &meta.LabelSelector{}
+		}
+		r := requirements(s.NamespaceSelector)
+		if len(s.ExcludeNamespaces) > 0 {
+			r = append(r, meta.LabelSelectorRequirement{
+				Key:      namespaceNameLabel,
+				Operator: meta.LabelSelectorOpNotIn,
+				Values:   s.ExcludeNamespaces,
+			})
+		}
+		rs = append(rs, r)
+	}
+	return commonSelector(rs)
+}
+
+// requirements returns the requirements of the supplied label selector, with
+// its matchLabels expressed as In requirements.
+func requirements(s *meta.LabelSelector) []meta.LabelSelectorRequirement {
+	if s == nil {
+		return nil
+	}
+	r := make([]meta.LabelSelectorRequirement, 0, len(s.MatchLabels)+len(s.MatchExpressions))
+	for k, v := range s.MatchLabels {
+		r = append(r, meta.LabelSelectorRequirement{Key: k, Operator: meta.LabelSelectorOpIn, Values: []string{v}})
+	}
+	return append(r, s.MatchExpressions...)
+}
+
+// commonSelector returns a label selector that selects every set of labels
+// that satisfies all of at least one of the supplied sets of requirements.
+func commonSelector(rs [][]meta.LabelSelectorRequirement) *meta.LabelSelector {
+	s := &meta.LabelSelector{}
+	if len(rs) == 0 {
+		return s
+	}
+	keys := sets.NewString()
+	for _, r := range rs[0] {
+		keys.Insert(r.Key)
+	}
+	for _, k := range keys.List() {
+		if r, ok := commonRequirement(k, rs); ok {
+			s.MatchExpressions = append(s.MatchExpressions, r)
+		}
+	}
+	return s
+}
+
+// commonRequirement returns a requirement of the supplied label key that is
+// satisfied by every set of labels that satisfies all of at least one of the
+// supplied sets of requirements, if there is such a requirement.
+func commonRequirement(key string, rs [][]meta.LabelSelectorRequirement) (meta.LabelSelectorRequirement, bool) {
+	var (
+		allIn, allExists, allNotIn, allDoesNotExist = true, true, true, true
+
+		in    = sets.NewString()
+		notIn sets.String
+	)
+	for _, r := range rs {
+		var hasIn, hasExists, hasNotIn, hasDoesNotExist bool
+		excluded := sets.NewString()
+		for _, req := range r {
+			if req.Key != key {
+				continue
+			}
+			switch req.Operator {
+			case meta.LabelSelectorOpIn:
+				hasIn, hasExists = true, true
+				in.Insert(req.Values...)
+			case meta.LabelSelectorOpExists:
+				hasExists = true
+			case meta.LabelSelectorOpNotIn:
+				hasNotIn = true
+				excluded.Insert(req.Values...)
+			case meta.LabelSelectorOpDoesNotExist:
+				hasDoesNotExist = true
+			}
+		}
+		allIn = allIn && hasIn
+		allExists = allExists && hasExists
+		allNotIn = allNotIn && hasNotIn
+		allDoesNotExist = allDoesNotExist && hasDoesNotExist
+		if notIn == nil {
+			notIn = excluded
+			continue
+		}
+		notIn = notIn.Intersection(excluded)
+	}
+
+	switch {
+	case allIn:
+		return meta.LabelSelectorRequirement{Key: key, Operator: meta.LabelSelectorOpIn, Values: in.List()}, true
+	case allExists:
+		return meta.LabelSelectorRequirement{Key: key, Operator: meta.LabelSelectorOpExists}, true
+	case allDoesNotExist:
+		return meta.LabelSelectorRequirement{Key: key, Operator: meta.LabelSelectorOpDoesNotExist}, true
+	case allNotIn && notIn.Len() > 0:
+		return meta.LabelSelectorRequirement{Key: key, Operator: meta.LabelSelectorOpNotIn, Values: notIn.List()}, true
+	}
+	return meta.LabelSelectorRequirement{}, false
+}
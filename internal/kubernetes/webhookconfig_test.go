@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	admissionregistration "k8s.io/api/admissionregistration/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewMutatingWebhookConfiguration(t *testing.T) {
+	var (
+		path    = "/webhook"
+		svc     = admissionregistration.ServiceReference{Namespace: "legion", Name: "legion", Path: &path}
+		ignore  = admissionregistration.Ignore
+		none    = admissionregistration.SideEffectClassNone
+		scope   = admissionregistration.NamespacedScope
+		timeout = int32(5)
+	)
+	selected := func(s *PodMutationSelector) PodMutation {
+		return PodMutation{Spec: PodMutationSpec{Selector: s}}
+	}
+
+	want := &admissionregistration.MutatingWebhookConfiguration{
+		TypeMeta:   meta.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: meta.ObjectMeta{Name: "legion.planet.com"},
+		Webhooks: []admissionregistration.MutatingWebhook{{
+			Name:         "legion.planet.com",
+			ClientConfig: admissionregistration.WebhookClientConfig{Service: &svc, CABundle: []byte("cool")},
+			Rules: []admissionregistration.RuleWithOperations{{
+				Operations: []admissionregistration.OperationType{admissionregistration.Create},
+				Rule: admissionregistration.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+					Scope:       &scope,
+				},
+			}},
+			FailurePolicy:           &ignore,
+			SideEffects:             &none,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			ObjectSelector: &meta.LabelSelector{MatchExpressions: []meta.LabelSelectorRequirement{
+				{Key: "cool", Operator: meta.LabelSelectorOpIn, Values: []string{"true"}},
+			}},
+			NamespaceSelector: &meta.LabelSelector{},
+		}},
+	}
+
+	pms := PodMutations{selected(&PodMutationSelector{LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}}})}
+	got := NewMutatingWebhookConfiguration("legion.planet.com", svc, []byte("cool"), pms, WithFailurePolicy(ignore), WithTimeoutSeconds(timeout))
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("NewMutatingWebhookConfiguration(...): got != want: %v", diff)
+	}
+}
+
+func TestMutatingWebhookOperations(t *testing.T) {
+	svc := admissionregistration.ServiceReference{Namespace: "legion", Name: "legion"}
+	create := []admissionregistration.OperationType{admissionregistration.Create}
+	createOrUpdate := []admissionregistration.OperationType{admissionregistration.Create, admissionregistration.Update}
+	update := []admissionregistration.OperationType{admissionregistration.Update}
+
+	cases := []struct {
+		name string
+		pms  PodMutations
+		want map[string][]admissionregistration.OperationType
+	}{
+		{
+			name: "Create",
+			pms:  PodMutations{{}},
+			want: map[string][]admissionregistration.OperationType{"pods": create},
+		},
+		{
+			name: "Update",
+			pms:  PodMutations{{Spec: PodMutationSpec{Operations: update}}},
+			want: map[string][]admissionregistration.OperationType{"pods": createOrUpdate},
+		},
+		{
+			name: "EphemeralContainers",
+			pms: PodMutations{{Spec: PodMutationSpec{
+				Operations:                 update,
+				EphemeralContainerTemplate: &ContainerTemplate{},
+			}}},
+			want: map[string][]admissionregistration.OperationType{
+				"pods":                     createOrUpdate,
+				"pods/ephemeralcontainers": update,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewMutatingWebhookConfiguration("legion.planet.com", svc, []byte("cool"), tc.pms)
+			got := map[string][]admissionregistration.OperationType{}
+			for _, r := range w.Webhooks[0].Rules {
+				for _, res := range r.Resources {
+					got[res] = r.Operations
+				}
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("w.Webhooks[0].Rules: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestNewWorkloadMutatingWebhook(t *testing.T) {
+	svc := admissionregistration.ServiceReference{Namespace: "legion", Name: "legion"}
+	pms := PodMutations{{Spec: PodMutationSpec{Selector: &PodMutationSelector{
+		LabelSelector:     meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}},
+		ExcludeNamespaces: []string{"kube-system"},
+	}}}}
+	w := NewWorkloadMutatingWebhook(WorkloadWebhookName("legion.planet.com"), svc, []byte("cool"), pms)
+
+	if got, want := w.Name, "workloads.legion.planet.com"; got != want {
+		t.Errorf("w.Name: got %q, want %q", got, want)
+	}
+	// The labels of workloads need not match those of their pod templates.
+	if w.ObjectSelector != nil {
+		t.Errorf("w.ObjectSelector: got %v, want nil", w.ObjectSelector)
+	}
+	wantNamespaces := &meta.LabelSelector{MatchExpressions: []meta.LabelSelectorRequirement{
+		{Key: namespaceNameLabel, Operator: meta.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
+	}}
+	if diff := deep.Equal(w.NamespaceSelector, wantNamespaces); diff != nil {
+		t.Errorf("w.NamespaceSelector: got != want: %v", diff)
+	}
+
+	got := map[string][]admissionregistration.OperationType{}
+	for _, r := range w.Rules {
+		for _, res := range r.Resources {
+			got[r.APIGroups[0]+"/"+res] = r.Operations
+		}
+	}
+	createOrUpdate := []admissionregistration.OperationType{admissionregistration.Create, admissionregistration.Update}
+	want := map[string][]admissionregistration.OperationType{
+		"apps/deployments":  createOrUpdate,
+		"apps/statefulsets": createOrUpdate,
+		"apps/daemonsets":   createOrUpdate,
+		"apps/replicasets":  createOrUpdate,
+		"batch/cronjobs":    createOrUpdate,
+		"batch/jobs":        {admissionregistration.Create},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("w.Rules: got != want: %v", diff)
+	}
+}
+
+func TestWebhookSelectors(t *testing.T) {
+	selected := func(s *PodMutationSelector) PodMutation {
+		return PodMutation{Spec: PodMutationSpec{Selector: s}}
+	}
+	labelled := func(ml map[string]string, me ...meta.LabelSelectorRequirement) *PodMutationSelector {
+		return &PodMutationSelector{LabelSelector: meta.LabelSelector{MatchLabels: ml, MatchExpressions: me}}
+	}
+
+	cases := []struct {
+		name          string
+		pms           PodMutations
+		wantObject    []meta.LabelSelectorRequirement
+		wantNamespace []meta.LabelSelectorRequirement
+	}{
+		{
+			name: "NoPodMutations",
+		},
+		{
+			name: "NoSelector",
+			pms:  PodMutations{selected(labelled(map[string]string{"cool": "true"})), selected(nil)},
+		},
+		{
+			name: "CommonLabels",
+			pms: PodMutations{
+				selected(labelled(map[string]string{"cool": "true", "tier": "frontend"})),
+				selected(labelled(map[string]string{"cool": "yes"}, meta.LabelSelectorRequirement{Key: "tier", Operator: meta.LabelSelectorOpExists})),
+			},
+			wantObject: []meta.LabelSelectorRequirement{
+				{Key: "cool", Operator: meta.LabelSelectorOpIn, Values: []string{"true", "yes"}},
+				{Key: "tier", Operator: meta.LabelSelectorOpExists},
+			},
+		},
+		{
+			name: "NoCommonLabels",
+			pms: PodMutations{
+				selected(labelled(map[string]string{"cool": "true"})),
+				selected(labelled(map[string]string{"tier": "frontend"})),
+			},
+		},
+		{
+			name: "Exclusions",
+			pms: PodMutations{
+				selected(labelled(nil,
+					meta.LabelSelectorRequirement{Key: "cool", Operator: meta.LabelSelectorOpNotIn, Values: []string{"false", "no"}},
+					meta.LabelSelectorRequirement{Key: "legacy", Operator: meta.LabelSelectorOpDoesNotExist},
+				)),
+				selected(labelled(nil,
+					meta.LabelSelectorRequirement{Key: "cool", Operator: meta.LabelSelectorOpNotIn, Values: []string{"false"}},
+					meta.LabelSelectorRequirement{Key: "legacy", Operator: meta.LabelSelectorOpDoesNotExist},
+				)),
+			},
+			wantObject: []meta.LabelSelectorRequirement{
+				{Key: "cool", Operator: meta.LabelSelectorOpNotIn, Values: []string{"false"}},
+				{Key: "legacy", Operator: meta.LabelSelectorOpDoesNotExist},
+			},
+		},
+		{
+			name: "Namespaces",
+			pms: PodMutations{
+				selected(&PodMutationSelector{
+					ExcludeNamespaces: []string{"kube-system", "kube-public"},
+					NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"tenant": "cool"}},
+				}),
+				selected(&PodMutationSelector{
+					ExcludeNamespaces: []string{"kube-system"},
+					NamespaceSelector: &meta.LabelSelector{MatchLabels: map[string]string{"tenant": "cooler"}},
+				}),
+			},
+			wantNamespace: []meta.LabelSelectorRequirement{
+				{Key: "kubernetes.io/metadata.name", Operator: meta.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
+				{Key: "tenant", Operator: meta.LabelSelectorOpIn, Values: []string{"cool", "cooler"}},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := deep.Equal(objectSelector(tc.pms).MatchExpressions, tc.wantObject); diff != nil {
+				t.Errorf("objectSelector(...): got != want: %v", diff)
+			}
+			if diff := deep.Equal(namespaceSelector(tc.pms).MatchExpressions, tc.wantNamespace); diff != nil {
+				t.Errorf("namespaceSelector(...): got != want: %v", diff)
+			}
+		})
+	}
+}
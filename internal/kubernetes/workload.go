@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/appscode/jsonpatch"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// templatePaths are the JSON pointers to the pod templates of the kinds of
+// workload whose pod templates Legion can mutate. Pod templates are located
+// at the same path in every version of each kind.
+var templatePaths = map[schema.GroupKind]string{
+	{Group: "apps", Kind: "Deployment"}:  "/spec/template",
+	{Group: "apps", Kind: "StatefulSet"}: "/spec/template",
+	{Group: "apps", Kind: "DaemonSet"}:   "/spec/template",
+	{Group: "apps", Kind: "ReplicaSet"}:  "/spec/template",
+	{Group: "batch", Kind: "Job"}:        "/spec/template",
+	{Group: "batch", Kind: "CronJob"}:    "/spec/jobTemplate/spec/template",
+}
+
+// PodTemplatePath returns the JSON pointer to the pod template of the supplied
+// kind of workload, and whether Legion can mutate its pod template.
+func PodTemplatePath(gk schema.GroupKind) (string, bool) {
+	p, ok := templatePaths[gk]
+	return p, ok
+}
+
+// PodFromWorkload returns a pod built from the pod template of the supplied
+// JSON encoded workload. The pod is in the workload's namespace unless its
+// template specifies otherwise.
+func PodFromWorkload(gk schema.GroupKind, data []byte) (core.Pod, error) {
+	path, ok := PodTemplatePath(gk)
+	if !ok {
+		return core.Pod{}, errors.Errorf("unsupported kind %s", gk)
+	}
+
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return core.Pod{}, errors.Wrap(err, "cannot decode workload")
+	}
+	t, ok, err := unstructured.NestedMap(u.Object, strings.Split(strings.TrimPrefix(path, "/"), "/")...)
+	if err != nil {
+		return core.Pod{}, errors.Wrapf(err, "cannot decode pod template at %s", path)
+	}
+	if !ok {
+		return core.Pod{}, errors.Errorf("%s has no pod template at %s", gk, path)
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return core.Pod{}, errors.Wrap(err, "cannot encode pod template")
+	}
+	pt := core.PodTemplateSpec{}
+	if err := json.Unmarshal(b, &pt); err != nil {
+		return core.Pod{}, errors.Wrapf(err, "cannot decode pod template at %s", path)
+	}
+
+	pod := core.Pod{
+		TypeMeta:   meta.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: pt.ObjectMeta,
+		Spec:       pt.Spec,
+	}
+	if pod.GetNamespace() == "" {
+		pod.SetNamespace(u.GetNamespace())
+	}
+	return pod, nil
+}
+
+// prefixPatch prefixes the path of each operation of the supplied RFC 6902
+// JSON patch, which must only modify the metadata and spec of a pod, such that
+// it applies to the pod template at the supplied path.
+func prefixPatch(patch []byte, prefix string) ([]byte, error) {
+	ops := []jsonpatch.Operation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(err, "cannot decode patch")
+	}
+	for i := range ops {
+		if !strings.HasPrefix(ops[i].Path, "/metadata/") && !strings.HasPrefix(ops[i].Path, "/spec/") {
+			return nil, errors.Errorf("cannot apply %s of %s to a pod template", ops[i].Operation, ops[i].Path)
+		}
+		ops[i].Path = prefix + ops[i].Path
+	}
+	b, err := json.Marshal(ops)
+	return b, errors.Wrap(err, "cannot encode patch as JSON")
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	rfc6902 "github.com/evanphx/json-patch"
+	"github.com/go-test/deep"
+	admission "k8s.io/api/admission/v1"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	coolTemplate = core.PodTemplateSpec{
+		ObjectMeta: meta.ObjectMeta{Labels: map[string]string{"cool": "true"}},
+		Spec:       core.PodSpec{Containers: []core.Container{{Name: "cool", Image: "cool:latest"}}},
+	}
+
+	coolDeployment = apps.Deployment{
+		TypeMeta:   meta.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: meta.ObjectMeta{Name: "cool", Namespace: "coolnamespace"},
+		Spec:       apps.DeploymentSpec{Template: coolTemplate},
+	}
+
+	coolCronJob = batchv1beta1.CronJob{
+		TypeMeta:   meta.TypeMeta{APIVersion: "batch/v1beta1", Kind: "CronJob"},
+		ObjectMeta: meta.ObjectMeta{Name: "cool", Namespace: "coolnamespace"},
+		Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+			Spec: batch.JobSpec{Template: coolTemplate},
+		}},
+	}
+)
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v): %v", v, err)
+	}
+	return b
+}
+
+func TestPodFromWorkload(t *testing.T) {
+	want := core.Pod{
+		TypeMeta:   meta.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: meta.ObjectMeta{Namespace: "coolnamespace", Labels: map[string]string{"cool": "true"}},
+		Spec:       coolTemplate.Spec,
+	}
+
+	cases := []struct {
+		name    string
+		gk      schema.GroupKind
+		data    func(t *testing.T) []byte
+		want    core.Pod
+		wantErr bool
+	}{
+		{
+			name: "Deployment",
+			gk:   schema.GroupKind{Group: "apps", Kind: "Deployment"},
+			data: func(t *testing.T) []byte { return mustJSON(t, coolDeployment) },
+			want: want,
+		},
+		{
+			name: "CronJob",
+			gk:   schema.GroupKind{Group: "batch", Kind: "CronJob"},
+			data: func(t *testing.T) []byte { return mustJSON(t, coolCronJob) },
+			want: want,
+		},
+		{
+			name:    "UnsupportedKind",
+			gk:      schema.GroupKind{Kind: "Service"},
+			data:    func(t *testing.T) []byte { return []byte("{}") },
+			wantErr: true,
+		},
+		{
+			name:    "MissingTemplate",
+			gk:      schema.GroupKind{Group: "apps", Kind: "Deployment"},
+			data:    func(t *testing.T) []byte { return []byte(`{"spec":{}}`) },
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := PodFromWorkload(tc.gk, tc.data(t))
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("PodFromWorkload(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("PodFromWorkload(...): want error, got nil")
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestPrefixPatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		patch   string
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Empty",
+			patch:  `[]`,
+			prefix: "/spec/template",
+			want:   `[]`,
+		},
+		{
+			name:   "Prefixed",
+			patch:  `[{"op":"add","path":"/metadata/annotations/cool","value":"true"},{"op":"remove","path":"/spec/hostNetwork"}]`,
+			prefix: "/spec/jobTemplate/spec/template",
+			want:   `[{"op":"add","path":"/spec/jobTemplate/spec/template/metadata/annotations/cool","value":"true"},{"op":"remove","path":"/spec/jobTemplate/spec/template/spec/hostNetwork"}]`,
+		},
+		{
+			name:    "OutsideTemplate",
+			patch:   `[{"op":"add","path":"/status/phase","value":"Running"}]`,
+			prefix:  "/spec/template",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := prefixPatch([]byte(tc.patch), tc.prefix)
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("prefixPatch(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("prefixPatch(...): want error, got nil")
+			}
+			if string(got) != tc.want {
+				t.Errorf("prefixPatch(...):\ngot:  %s\nwant: %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReviewWorkload(t *testing.T) {
+	pms := PodMutations{{
+		ObjectMeta: meta.ObjectMeta{Name: "annotate"},
+		Spec: PodMutationSpec{
+			Selector: &PodMutationSelector{LabelSelector: meta.LabelSelector{MatchLabels: map[string]string{"cool": "true"}}},
+			Template: PodMutationTemplate{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{"cool": "true"}}},
+		},
+	}}
+	hash, err := hashPodMutationSpec(pms[0].Spec)
+	if err != nil {
+		t.Fatalf("hashPodMutationSpec(...): %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		options []PodMutatorOption
+		want    *admission.AdmissionResponse
+	}{
+		{
+			name: "WorkloadsDisabled",
+			want: &admission.AdmissionResponse{
+				Result: &meta.Status{
+					Status:  meta.StatusFailure,
+					Reason:  meta.StatusReasonInvalid,
+					Message: "cannot review non-pod resource",
+				},
+			},
+		},
+		{
+			name:    "WorkloadsEnabled",
+			options: []PodMutatorOption{WithWorkloads()},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(fmt.Sprintf(`[{"op":"add","path":"/spec/template/metadata/annotations","value":{"cool":"true","legion.planet.com/mutation":"mutated","legion.planet.com/mutation-applied":"annotate=%s"}}]`, hash)),
+				PatchType: &jsonPatch,
+			},
+		},
+		{
+			name:    "CustomMarker",
+			options: []PodMutatorOption{WithWorkloads(), WithMarker("marker")},
+			want: &admission.AdmissionResponse{
+				Allowed:   true,
+				Patch:     []byte(fmt.Sprintf(`[{"op":"add","path":"/spec/template/metadata/annotations","value":{"cool":"true","marker":"mutated","marker-applied":"annotate=%s"}}]`, hash)),
+				PatchType: &jsonPatch,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := &admission.AdmissionRequest{
+				Kind:      meta.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Resource:  meta.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Namespace: "coolnamespace",
+				Object:    runtime.RawExtension{Raw: mustJSON(t, coolDeployment)},
+			}
+			got := NewPodMutator(pms, tc.options...).Review(ar)
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("got != want:\n%v\nstringified patch: %s", diff, got.Patch)
+			}
+		})
+	}
+}
+
+func TestReviewWorkloadUpdates(t *testing.T) {
+	pms := PodMutations{{
+		ObjectMeta: meta.ObjectMeta{Name: "sidecar"},
+		Spec: PodMutationSpec{
+			Strategy: PodMutationStrategy{Append: true},
+			Template: PodMutationTemplate{Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "cool", Args: []string{"--cool"}}},
+			}},
+		},
+	}}
+	m := NewPodMutator(pms, WithWorkloads())
+
+	// Each update reviews the workload as patched by the previous review.
+	old := mustJSON(t, coolDeployment)
+	for i := 0; i < 2; i++ {
+		rsp := m.Review(&admission.AdmissionRequest{
+			Kind:      meta.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Resource:  meta.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			Namespace: "coolnamespace",
+			Operation: admission.Update,
+			Object:    runtime.RawExtension{Raw: old},
+			OldObject: runtime.RawExtension{Raw: old},
+		})
+		if !rsp.Allowed {
+			t.Fatalf("update %d: m.Review(...): %s", i, rsp.Result.Message)
+		}
+		p, err := rfc6902.DecodePatch(rsp.Patch)
+		if err != nil {
+			t.Fatalf("update %d: rfc6902.DecodePatch(%s): %v", i, rsp.Patch, err)
+		}
+		updated, err := p.Apply(old)
+		if err != nil {
+			t.Fatalf("update %d: p.Apply(...): %v", i, err)
+		}
+		if i > 0 && !rfc6902.Equal(updated, old) {
+			t.Errorf("update %d: patch %s is not idempotent", i, rsp.Patch)
+		}
+		old = updated
+	}
+
+	d := apps.Deployment{}
+	if err := json.Unmarshal(old, &d); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	if diff := deep.Equal(d.Spec.Template.Spec.Containers[0].Args, []string{"--cool"}); diff != nil {
+		t.Errorf("d.Spec.Template.Spec.Containers[0].Args: got != want: %v", diff)
+	}
+}